@@ -3,20 +3,24 @@ module github.com/mtanda/grafana-aws-athena-datasource
 go 1.12
 
 require (
-	github.com/aws/aws-sdk-go v1.19.37
+	github.com/aws/aws-sdk-go v1.38.0
 	github.com/bmizerany/assert v0.0.0-20160611221934-b7ed37b82869
 	github.com/davecgh/go-spew v1.1.1
 	github.com/grafana/grafana v6.0.1+incompatible
 	github.com/grafana/grafana-plugin-model v0.0.0-20200514130833-df1eb6bdf4c5
-	github.com/grafana/grafana-plugin-sdk-go v0.79.0
+	github.com/grafana/grafana-plugin-sdk-go v0.105.0
 	github.com/hashicorp/go-hclog v0.8.0 // indirect
 	github.com/hashicorp/go-plugin v1.2.2
 	github.com/kr/pretty v0.1.0 // indirect
-	github.com/magefile/mage v1.10.0 // indirect
 	github.com/mitchellh/go-testing-interface v1.0.0 // indirect
+	github.com/modern-go/reflect2 v1.0.3-0.20250322232337-35a7c28c31ee // indirect
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/prometheus/client_golang v1.3.0
-	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
+	github.com/prometheus/client_golang v1.10.0
+	go.opentelemetry.io/otel v0.19.0
+	go.opentelemetry.io/otel/exporters/otlp v0.19.0
+	go.opentelemetry.io/otel/sdk v0.19.0
+	go.opentelemetry.io/otel/trace v0.19.0
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b
 	google.golang.org/api v0.27.0
 	gotest.tools v2.2.0+incompatible
 )
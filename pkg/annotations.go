@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const FORMAT_ANNOTATIONS = "annotations"
+
+var (
+	annotationTimeEndColumns = []string{"timeEnd", "time_end", "end_time", "endtime"}
+	annotationTitleColumns   = []string{"title"}
+	annotationTextColumns    = []string{"text", "description", "message"}
+	annotationTagsColumns    = []string{"tags", "tag"}
+)
+
+// annotationColumns is the mapping of the result columns to the annotation fields, empty column is detected from the column names.
+type annotationColumns struct {
+	Time    string
+	TimeEnd string
+	Title   string
+	Text    string
+	Tags    string
+}
+
+// parseAnnotationsResponse builds the frame of the annotations, which has time, timeEnd, title, text and tags fields.
+func parseAnnotationsResponse(resp *athena.GetQueryResultsOutput, refId string, ac annotationColumns, timeFormat string) ([]*data.Frame, error) {
+	columns := resp.ResultSet.ResultSetMetadata.ColumnInfo
+
+	timeIndex, err := detectColumn(columns, ac.Time, logTimeColumns, nil)
+	if err != nil {
+		return nil, err
+	}
+	if timeIndex == -1 {
+		timeIndex, _ = detectColumn(columns, "", nil, []string{"timestamp", "date"})
+	}
+	if timeIndex == -1 {
+		return nil, fmt.Errorf("time column not found, specify timestampColumn")
+	}
+	timeEndIndex, err := detectColumn(columns, ac.TimeEnd, annotationTimeEndColumns, nil, timeIndex)
+	if err != nil {
+		return nil, err
+	}
+	titleIndex, err := detectColumn(columns, ac.Title, annotationTitleColumns, nil)
+	if err != nil {
+		return nil, err
+	}
+	textIndex, err := detectColumn(columns, ac.Text, annotationTextColumns, nil, titleIndex)
+	if err != nil {
+		return nil, err
+	}
+	tagsIndex, err := detectColumn(columns, ac.Tags, annotationTagsColumns, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	timeConverter := timeColumnConverter(columns[timeIndex], timeFormat)
+	var timeEndConverter data.FieldConverter
+	if timeEndIndex != -1 {
+		timeEndConverter = timeColumnConverter(columns[timeEndIndex], timeFormat)
+	}
+
+	frame := data.NewFrame("annotations",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("timeEnd", nil, []*time.Time{}),
+		data.NewField("title", nil, []string{}),
+		data.NewField("text", nil, []string{}),
+		data.NewField("tags", nil, []string{}),
+	)
+	frame.RefID = refId
+	for _, row := range resp.ResultSet.Rows {
+		cell := row.Data[timeIndex]
+		if cell == nil || cell.VarCharValue == nil {
+			continue
+		}
+		t, err := convertTime(timeConverter, *cell.VarCharValue)
+		if err != nil {
+			return nil, err
+		}
+		var timeEnd *time.Time
+		if timeEndIndex != -1 && row.Data[timeEndIndex] != nil && row.Data[timeEndIndex].VarCharValue != nil {
+			timeEnd, err = convertTime(timeEndConverter, *row.Data[timeEndIndex].VarCharValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var title, text, tags string
+		if titleIndex != -1 {
+			title = cellString(row.Data[titleIndex])
+		}
+		if textIndex != -1 {
+			text = cellString(row.Data[textIndex])
+		}
+		if tagsIndex != -1 {
+			tags = strings.Join(splitTags(cellString(row.Data[tagsIndex])), ",")
+		}
+		frame.AppendRow(*t, timeEnd, title, text, tags)
+	}
+	return []*data.Frame{frame}, nil
+}
+
+// splitTags splits the comma separated tags, Athena array value like "[a, b]" is handled as well.
+func splitTags(s string) []string {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
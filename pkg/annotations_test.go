@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"gotest.tools/assert"
+)
+
+func TestAnnotations(t *testing.T) {
+	t.Run("parseAnnotationsResponse", func(t *testing.T) {
+		resp := &athena.GetQueryResultsOutput{
+			ResultSet: &athena.ResultSet{
+				ResultSetMetadata: &athena.ResultSetMetadata{
+					ColumnInfo: []*athena.ColumnInfo{
+						{Name: aws.String("deployed_at"), Type: aws.String("varchar")},
+						{Name: aws.String("finished_at"), Type: aws.String("timestamp")},
+						{Name: aws.String("service"), Type: aws.String("varchar")},
+						{Name: aws.String("description"), Type: aws.String("varchar")},
+						{Name: aws.String("labels"), Type: aws.String("array(varchar)")},
+					},
+				},
+				Rows: []*athena.Row{
+					{Data: []*athena.Datum{{VarCharValue: aws.String("2021-01-01T00:00:00Z")}, {VarCharValue: aws.String("2021-01-01 00:10:00.000")}, {VarCharValue: aws.String("api")}, {VarCharValue: aws.String("v1.2.3")}, {VarCharValue: aws.String("[deploy, api]")}}},
+					{Data: []*athena.Datum{{VarCharValue: aws.String("2021-01-02T00:00:00Z")}, {}, {VarCharValue: aws.String("web")}, {}, {}}},
+				},
+			},
+		}
+		frames, err := parseAnnotationsResponse(resp, "Anno", annotationColumns{Time: "deployed_at", TimeEnd: "finished_at", Title: "service", Tags: "labels"}, time.RFC3339Nano)
+		assert.NilError(t, err)
+		assert.Equal(t, 1, len(frames))
+		frame := frames[0]
+		assert.Equal(t, "Anno", frame.RefID)
+		assert.Equal(t, 2, frame.Rows())
+		assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), frame.Fields[0].At(0))
+		assert.Equal(t, time.Date(2021, 1, 1, 0, 10, 0, 0, time.UTC), *frame.Fields[1].At(0).(*time.Time))
+		assert.Assert(t, frame.Fields[1].At(1).(*time.Time) == nil)
+		assert.Equal(t, "api", frame.Fields[2].At(0))
+		assert.Equal(t, "v1.2.3", frame.Fields[3].At(0))
+		assert.Equal(t, "deploy,api", frame.Fields[4].At(0))
+		assert.Equal(t, "", frame.Fields[4].At(1))
+
+		// the first timestamp column is used when the time column isn't found by the name
+		frames, err = parseAnnotationsResponse(resp, "Anno", annotationColumns{}, time.RFC3339Nano)
+		assert.NilError(t, err)
+		assert.Equal(t, 1, frames[0].Rows())
+		assert.Equal(t, "v1.2.3", frames[0].Fields[3].At(0))
+
+		_, err = parseAnnotationsResponse(resp, "Anno", annotationColumns{Time: "ts"}, time.RFC3339Nano)
+		assert.Error(t, err, "column not found: ts")
+	})
+
+	t.Run("splitTags", func(t *testing.T) {
+		assert.DeepEqual(t, []string{"a", "b"}, splitTags("a, b,"))
+		assert.DeepEqual(t, []string{"a", "b c"}, splitTags("[a, b c]"))
+		assert.DeepEqual(t, []string{}, splitTags("[]"))
+	})
+}
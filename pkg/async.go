@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+)
+
+// started queries can be polled in this duration
+const ASYNC_QUERY_TTL = 1 * time.Hour
+
+// asyncQuery is the query started by the async_query_start resource, it is kept to poll, fetch and cancel the query execution.
+type asyncQuery struct {
+	OrgID int64
+	From  time.Time
+	To    time.Time
+	Query json.RawMessage
+}
+
+type asyncQueryRequest struct {
+	From  time.Time       `json:"from"`
+	To    time.Time       `json:"to"`
+	Query json.RawMessage `json:"query"`
+}
+
+type asyncQueryStarted struct {
+	QueryExecutionID string   `json:"queryExecutionId"`
+	Warnings         []string `json:"warnings"`
+}
+
+type asyncQueryStatus struct {
+	QueryExecutionID          string     `json:"queryExecutionId"`
+	State                     string     `json:"state"`
+	StateChangeReason         string     `json:"stateChangeReason,omitempty"`
+	DataScannedBytes          int64      `json:"dataScannedBytes"`
+	QueueTimeMillis           int64      `json:"queueTimeMillis"`
+	EngineExecutionTimeMillis int64      `json:"engineExecutionTimeMillis"`
+	SubmissionDateTime        *time.Time `json:"submissionDateTime,omitempty"`
+	CompletionDateTime        *time.Time `json:"completionDateTime,omitempty"`
+}
+
+func asyncQueryCacheKey(datasourceID int64, queryExecutionID string) string {
+	return "AsyncQuery/" + strconv.FormatInt(datasourceID, 10) + "/" + queryExecutionID
+}
+
+func (ds *AwsAthenaDatasource) handleResourceAsyncQueryStart(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+
+	var ar asyncQueryRequest
+	if err := json.NewDecoder(req.Body).Decode(&ar); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	target, err := ds.newQueryTarget(ctx, pluginContext, ar.Query, ar.From, ar.To)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	if target.QueryString == "" {
+		writeResult(rw, "?", nil, fmt.Errorf("queryString should be set"))
+		return
+	}
+
+	queryExecutionID, err := target.startQuery(ctx, pluginContext)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	ds.asyncQueries.Set(asyncQueryCacheKey(pluginContext.DataSourceInstanceSettings.ID, queryExecutionID), asyncQuery{
+		OrgID: pluginContext.OrgID,
+		From:  ar.From,
+		To:    ar.To,
+		Query: ar.Query,
+	}, ASYNC_QUERY_TTL)
+
+	started := asyncQueryStarted{QueryExecutionID: queryExecutionID, Warnings: target.warnings}
+	if started.Warnings == nil {
+		started.Warnings = make([]string, 0)
+	}
+	writeResult(rw, "async_query_start", started, nil)
+}
+
+func (ds *AwsAthenaDatasource) handleResourceAsyncQueryPoll(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	queryExecutionID := req.URL.Query().Get("queryExecutionId")
+
+	target, err := ds.getAsyncQueryTarget(ctx, pluginContext, queryExecutionID)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	e, err := target.getQueryExecution(ctx, queryExecutionID)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	// the completed query execution is recorded only once
+	if target.completeExecution(e) {
+		target.auditExecutions([]*string{e.QueryExecutionId}, []*athena.QueryExecution{e})
+	}
+
+	writeResult(rw, "async_query_poll", newAsyncQueryStatus(e), nil)
+}
+
+func (ds *AwsAthenaDatasource) handleResourceAsyncQueryResults(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	queryExecutionID := req.URL.Query().Get("queryExecutionId")
+
+	target, err := ds.getAsyncQueryTarget(ctx, pluginContext, queryExecutionID)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	e, err := target.getQueryExecution(ctx, queryExecutionID)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	if state := aws.StringValue(e.Status.State); state != athena.QueryExecutionStateSucceeded {
+		writeResult(rw, "?", nil, fmt.Errorf("query execution is not succeeded: %s", state))
+		return
+	}
+
+	// get the results of the started query execution, the same as the query execution id query.
+	// The query execution id query doesn't wait for the completion, it is a no-wait fetch of the succeeded execution.
+	target.QueryString = ""
+	target.Inputs = []athena.GetQueryResultsInput{{QueryExecutionId: aws.String(queryExecutionID)}}
+	responses := backend.QueryDataResponse{
+		Responses: map[string]backend.DataResponse{},
+	}
+	if frames, err := target.getFrames(ctx, pluginContext); err != nil {
+		responses.Responses[target.RefId] = backend.DataResponse{Error: err}
+	} else {
+		responses.Responses[target.RefId] = backend.DataResponse{Frames: frames}
+	}
+
+	writeResult(rw, "async_query_results", responses, nil)
+}
+
+func (ds *AwsAthenaDatasource) handleResourceAsyncQueryCancel(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	queryExecutionID := req.URL.Query().Get("queryExecutionId")
+
+	target, err := ds.getAsyncQueryTarget(ctx, pluginContext, queryExecutionID)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	if _, err := target.client.StopQueryExecutionWithContext(ctx, &athena.StopQueryExecutionInput{
+		QueryExecutionId: aws.String(queryExecutionID),
+	}); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	writeResult(rw, "async_query_cancel", queryExecutionID, nil)
+}
+
+// getAsyncQueryTarget returns the query target of the query execution started by the async_query_start resource.
+// Query executions started in other organizations are not found.
+func (ds *AwsAthenaDatasource) getAsyncQueryTarget(ctx context.Context, pluginContext backend.PluginContext, queryExecutionID string) (AwsAthenaQuery, error) {
+	item, found := ds.asyncQueries.Get(asyncQueryCacheKey(pluginContext.DataSourceInstanceSettings.ID, queryExecutionID))
+	aq, ok := item.(asyncQuery)
+	if !found || !ok || aq.OrgID != pluginContext.OrgID {
+		return AwsAthenaQuery{}, fmt.Errorf("query execution not found: %s", queryExecutionID)
+	}
+	return ds.newQueryTarget(ctx, pluginContext, aq.Query, aq.From, aq.To)
+}
+
+func (query *AwsAthenaQuery) getQueryExecution(ctx context.Context, queryExecutionID string) (*athena.QueryExecution, error) {
+	o, err := query.client.GetQueryExecutionWithContext(ctx, &athena.GetQueryExecutionInput{
+		QueryExecutionId: aws.String(queryExecutionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.QueryExecution, nil
+}
+
+func newAsyncQueryStatus(e *athena.QueryExecution) asyncQueryStatus {
+	status := asyncQueryStatus{
+		QueryExecutionID: aws.StringValue(e.QueryExecutionId),
+	}
+	if e.Status != nil {
+		status.State = aws.StringValue(e.Status.State)
+		status.StateChangeReason = aws.StringValue(e.Status.StateChangeReason)
+		status.SubmissionDateTime = e.Status.SubmissionDateTime
+		status.CompletionDateTime = e.Status.CompletionDateTime
+	}
+	if e.Statistics != nil {
+		status.DataScannedBytes = aws.Int64Value(e.Statistics.DataScannedInBytes)
+		status.QueueTimeMillis = aws.Int64Value(e.Statistics.QueryQueueTimeInMillis)
+		status.EngineExecutionTimeMillis = aws.Int64Value(e.Statistics.EngineExecutionTimeInMillis)
+	}
+	return status
+}
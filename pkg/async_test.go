@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+func TestAsyncQuery(t *testing.T) {
+	t.Run("getAsyncQueryTarget", func(t *testing.T) {
+		ds := &AwsAthenaDatasource{asyncQueries: cache.New(ASYNC_QUERY_TTL, time.Minute)}
+		ds.asyncQueries.Set(asyncQueryCacheKey(2, "id1"), asyncQuery{OrgID: 1}, ASYNC_QUERY_TTL)
+
+		otherOrg := backend.PluginContext{OrgID: 3, DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 2}}
+		_, err := ds.getAsyncQueryTarget(context.Background(), otherOrg, "id1")
+		assert.Error(t, err, "query execution not found: id1")
+
+		pluginContext := backend.PluginContext{OrgID: 1, DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 2}}
+		_, err = ds.getAsyncQueryTarget(context.Background(), pluginContext, "id2")
+		assert.Error(t, err, "query execution not found: id2")
+	})
+
+	t.Run("results of other org are rejected", func(t *testing.T) {
+		fake, server := newFakeAthenaServer(t)
+		defer server.Close()
+		ds := newTestDataSource()
+		mux := http.NewServeMux()
+		mux.HandleFunc("/async_query_start", ds.handleResourceAsyncQueryStart)
+		mux.HandleFunc("/async_query_results", ds.handleResourceAsyncQueryResults)
+		handler := httpadapter.New(mux)
+		settings := &backend.DataSourceInstanceSettings{
+			ID:       102,
+			JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `"}`),
+			DecryptedSecureJSONData: map[string]string{
+				"accessKey": "AKID",
+				"secretKey": "secret",
+			},
+		}
+		call := func(orgID int64, method string, path string, query string, body string) map[string]json.RawMessage {
+			var res *backend.CallResourceResponse
+			err := handler.CallResource(context.Background(), &backend.CallResourceRequest{
+				PluginContext: backend.PluginContext{OrgID: orgID, DataSourceInstanceSettings: settings},
+				Path:          path,
+				Method:        method,
+				URL:           path + query,
+				Body:          []byte(body),
+			}, resourceResponseFunc(func(r *backend.CallResourceResponse) error {
+				res = r
+				return nil
+			}))
+			assert.NilError(t, err)
+			result := make(map[string]json.RawMessage)
+			assert.NilError(t, json.Unmarshal(res.Body, &result))
+			return result
+		}
+
+		started := call(1, http.MethodPost, "async_query_start", "", `{"query":{"refId":"A","region":"default","workgroup":"primary","queryString":"SELECT 1","format":"table"}}`)
+		var s asyncQueryStarted
+		assert.NilError(t, json.Unmarshal(started["async_query_start"], &s))
+		assert.Equal(t, "qid-1", s.QueryExecutionID)
+
+		denied := call(2, http.MethodGet, "async_query_results", "?queryExecutionId=qid-1", "")
+		assert.Equal(t, `"query execution not found: qid-1"`, string(denied["error"]))
+		assert.Equal(t, 0, fake.count("GetQueryResults"))
+
+		// the results are fetched without the wait, the execution state is got once by the batch get of the execution id query
+		batchGets := fake.count("BatchGetQueryExecution")
+		start := time.Now()
+		results := call(1, http.MethodGet, "async_query_results", "?queryExecutionId=qid-1", "")
+		_, ok := results["async_query_results"]
+		assert.Assert(t, ok)
+		assert.Equal(t, 1, fake.count("GetQueryResults"))
+		assert.Equal(t, batchGets+1, fake.count("BatchGetQueryExecution"))
+		assert.Assert(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("newAsyncQueryStatus", func(t *testing.T) {
+		status := newAsyncQueryStatus(&athena.QueryExecution{
+			QueryExecutionId: aws.String("id1"),
+			Status:           &athena.QueryExecutionStatus{State: aws.String("FAILED"), StateChangeReason: aws.String("SYNTAX_ERROR: line 1:8")},
+			Statistics:       &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(100), EngineExecutionTimeInMillis: aws.Int64(300)},
+		})
+		assert.DeepEqual(t, asyncQueryStatus{
+			QueryExecutionID:          "id1",
+			State:                     "FAILED",
+			StateChangeReason:         "SYNTAX_ERROR: line 1:8",
+			DataScannedBytes:          100,
+			EngineExecutionTimeMillis: 300,
+		}, status)
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const attributionCommentPrefix = "/* grafana:"
+
+// attributionUnsafePattern matches the characters which are not allowed in the values of the attribution comment,
+// the comment can't be closed by the user login or the refId.
+var attributionUnsafePattern = regexp.MustCompile(`[^A-Za-z0-9_.@-]`)
+
+// WorkgroupRoute routes the posted queries to the workgroup, so that the cost is allocated by the workgroup tags.
+// Empty matchers match any request, and the first matched route is used.
+// Teams are not matched, Grafana doesn't send the teams of the user to the plugin.
+type WorkgroupRoute struct {
+	OrgIDs    []int64  `json:"orgIds"`
+	Users     []string `json:"users"`
+	Roles     []string `json:"roles"`
+	WorkGroup string   `json:"workgroup"`
+}
+
+func (r WorkgroupRoute) match(orgID int64, user string, role string) bool {
+	if len(r.OrgIDs) > 0 {
+		found := false
+		for _, id := range r.OrgIDs {
+			if id == orgID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Users) > 0 && !containsFold(r.Users, user) {
+		return false
+	}
+	if len(r.Roles) > 0 && !containsFold(r.Roles, role) {
+		return false
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeWorkgroup returns the workgroup of the first matched route, or the workgroup as is.
+func (dsInfo *DatasourceInfo) routeWorkgroup(workGroup string, orgID int64, user string, role string) string {
+	for _, r := range dsInfo.WorkgroupRoutes {
+		if r.WorkGroup != "" && r.match(orgID, user, role) {
+			return r.WorkGroup
+		}
+	}
+	return workGroup
+}
+
+// attributionComment returns the comment which identifies the requester in Athena query history.
+func (query *AwsAthenaQuery) attributionComment() string {
+	sanitize := func(s string) string {
+		return attributionUnsafePattern.ReplaceAllString(s, "_")
+	}
+	return fmt.Sprintf("%s user=%s org=%d datasource=%d dashboard=%d panel=%d refId=%s */\n",
+		attributionCommentPrefix, sanitize(query.user), query.orgID, query.datasourceID, query.DashboardId, query.PanelId, sanitize(query.RefId))
+}
+
+// stripAttributionComment removes the attribution comment from the query string of the query execution.
+func stripAttributionComment(queryString string) string {
+	if !strings.HasPrefix(queryString, attributionCommentPrefix) {
+		return queryString
+	}
+	if i := strings.Index(queryString, "*/\n"); i != -1 {
+		return queryString[i+3:]
+	}
+	return queryString
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestAttribution(t *testing.T) {
+	t.Run("routeWorkgroup", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{WorkgroupRoutes: []WorkgroupRoute{
+			{OrgIDs: []int64{2}, Roles: []string{"Admin"}, WorkGroup: "org2-admin"},
+			{OrgIDs: []int64{2}, WorkGroup: "org2"},
+			{Users: []string{"alice"}, WorkGroup: "alice"},
+		}}
+		assert.Equal(t, "org2-admin", dsInfo.routeWorkgroup("primary", 2, "bob", "admin"))
+		assert.Equal(t, "org2", dsInfo.routeWorkgroup("primary", 2, "alice", "Viewer"))
+		assert.Equal(t, "alice", dsInfo.routeWorkgroup("primary", 1, "alice", "Viewer"))
+		assert.Equal(t, "primary", dsInfo.routeWorkgroup("primary", 1, "bob", "Viewer"))
+	})
+
+	t.Run("attributionComment", func(t *testing.T) {
+		query := &AwsAthenaQuery{RefId: "A", DashboardId: 4, PanelId: 2, orgID: 1, datasourceID: 3, user: "eve*/ DROP"}
+		comment := query.attributionComment()
+		assert.Equal(t, "/* grafana: user=eve___DROP org=1 datasource=3 dashboard=4 panel=2 refId=A */\n", comment)
+		assert.Equal(t, "SELECT 1", stripAttributionComment(comment+"SELECT 1"))
+		assert.Equal(t, "SELECT 1", stripAttributionComment("SELECT 1"))
+
+		query = &AwsAthenaQuery{RefId: "A", user: "alice.b-c_d@example.com"}
+		assert.Equal(t, "/* grafana: user=alice.b-c_d@example.com org=0 datasource=0 dashboard=0 panel=0 refId=A */\n", query.attributionComment())
+	})
+
+	t.Run("attributionComment can't be closed", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{AttributionComment: true}
+		for _, payload := range []string{"**//\nDROP TABLE t; --", "*/*/\nDROP TABLE t; --", "*/ DROP TABLE t /*", "a\n*/DROP TABLE t"} {
+			query := &AwsAthenaQuery{RefId: payload, user: payload}
+			comment := query.attributionComment()
+			assert.Assert(t, !strings.Contains(comment[2:len(comment)-3], "*/"), comment)
+			assert.Assert(t, !strings.Contains(comment[:len(comment)-1], "\n"), comment)
+			assert.NilError(t, checkQueryGuardrails(dsInfo, comment+"SELECT 1"))
+			assert.Equal(t, "SELECT 1", stripAttributionComment(comment+"SELECT 1"))
+		}
+
+		// the closed comment is rejected by the guardrails of the posted query string
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "/* grafana: user=* */DROP TABLE t; -- */\nSELECT 1"), "not allowed")
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	AUDIT_LOG_SINK_LOGGER = "logger"
+	AUDIT_LOG_SINK_FILE   = "file"
+	// the file sink writes only in the directory configured by the operator, not by the datasource settings
+	AUDIT_LOG_DIR_ENV = "GF_PLUGIN_ATHENA_AUDIT_LOG_DIR"
+
+	AUDIT_EVENT_EXECUTION    = "execution"
+	AUDIT_EVENT_START_FAILED = "start_failed"
+	AUDIT_EVENT_CACHE_HIT    = "cache_hit"
+)
+
+// auditRecord is a line of the audit log, one record is written per query execution or cache hit.
+type auditRecord struct {
+	Time             time.Time `json:"time"`
+	Event            string    `json:"event"`
+	OrgID            int64     `json:"orgId"`
+	User             string    `json:"user,omitempty"`
+	DatasourceID     int64     `json:"datasourceId"`
+	DashboardID      int64     `json:"dashboardId,omitempty"`
+	PanelID          int64     `json:"panelId,omitempty"`
+	RefID            string    `json:"refId,omitempty"`
+	Region           string    `json:"region"`
+	WorkGroup        string    `json:"workgroup"`
+	QueryHash        string    `json:"queryHash"`
+	QueryString      string    `json:"queryString"`
+	ExecutionID      string    `json:"executionId,omitempty"`
+	DataScannedBytes *int64    `json:"dataScannedBytes,omitempty"`
+	State            string    `json:"state,omitempty"`
+	Error            string    `json:"error,omitempty"`
+}
+
+// auditLogger writes the audit records to the sink configured in the datasource settings.
+// Files are opened per datasource, and closed when the datasource instance is disposed.
+type auditLogger struct {
+	lock  sync.Mutex
+	dir   string
+	files map[int64]*os.File
+}
+
+var defaultAuditLogger = newAuditLogger()
+
+func newAuditLogger() *auditLogger {
+	return &auditLogger{
+		dir:   os.Getenv(AUDIT_LOG_DIR_ENV),
+		files: make(map[int64]*os.File),
+	}
+}
+
+func (l *auditLogger) write(dsInfo *DatasourceInfo, record auditRecord) {
+	if l == nil || dsInfo == nil {
+		return
+	}
+	switch dsInfo.AuditLogSink {
+	case "":
+		return
+	case AUDIT_LOG_SINK_LOGGER:
+		b, err := json.Marshal(record)
+		if err != nil {
+			backend.Logger.Warn("Audit Log Warning", "warn", err.Error())
+			return
+		}
+		backend.Logger.Info("Audit", "record", string(b))
+	case AUDIT_LOG_SINK_FILE:
+		if err := l.writeFile(record.DatasourceID, dsInfo.AuditLogPath, record); err != nil {
+			backend.Logger.Warn("Audit Log Warning", "warn", err.Error(), "path", dsInfo.AuditLogPath)
+		}
+	default:
+		backend.Logger.Warn("Audit Log Warning", "warn", fmt.Sprintf("unknown audit log sink: %s", dsInfo.AuditLogSink))
+	}
+}
+
+// filePath returns the path of the audit log file in the audit log directory, the name can't point outside of it.
+func (l *auditLogger) filePath(name string) (string, error) {
+	if l.dir == "" {
+		return "", fmt.Errorf("file audit log sink requires %s environment variable", AUDIT_LOG_DIR_ENV)
+	}
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return "", fmt.Errorf("audit log path should be a file name in the audit log directory: %s", name)
+	}
+	return filepath.Join(l.dir, name), nil
+}
+
+func (l *auditLogger) writeFile(datasourceID int64, name string, record auditRecord) error {
+	path, err := l.filePath(name)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	f, ok := l.files[datasourceID]
+	if ok && f.Name() != path {
+		f.Close()
+		ok = false
+	}
+	if !ok {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		l.files[datasourceID] = f
+	}
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// close closes the audit log file of the datasource, it is opened again on the next write.
+func (l *auditLogger) close(datasourceID int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if f, ok := l.files[datasourceID]; ok {
+		if err := f.Close(); err != nil {
+			backend.Logger.Warn("Audit Log Warning", "warn", err.Error(), "path", f.Name())
+		}
+		delete(l.files, datasourceID)
+	}
+}
+
+// auditRecord returns the record of the query, identifiers of the requester are filled.
+func (query *AwsAthenaQuery) auditRecord(event string, queryString string, executionID string) auditRecord {
+	record := auditRecord{
+		Time:         time.Now(),
+		Event:        event,
+		OrgID:        query.orgID,
+		User:         query.user,
+		DatasourceID: query.datasourceID,
+		DashboardID:  query.DashboardId,
+		PanelID:      query.PanelId,
+		RefID:        query.RefId,
+		Region:       query.Region,
+		WorkGroup:    query.WorkGroup,
+		QueryHash:    queryHash(queryString),
+		QueryString:  queryString,
+		ExecutionID:  executionID,
+	}
+	return record
+}
+
+// auditExecutions writes the records of the started query executions with the final state.
+func (query *AwsAthenaQuery) auditExecutions(waitQueryExecutionIds []*string, executions []*athena.QueryExecution) {
+	if query.audit == nil {
+		return
+	}
+	found := make(map[string]*athena.QueryExecution)
+	for _, e := range executions {
+		found[aws.StringValue(e.QueryExecutionId)] = e
+	}
+	for _, id := range waitQueryExecutionIds {
+		e, ok := found[aws.StringValue(id)]
+		if !ok {
+			record := query.auditRecord(AUDIT_EVENT_EXECUTION, query.QueryString, aws.StringValue(id))
+			record.State = "UNKNOWN"
+			query.audit.write(query.dsInfo, record)
+			continue
+		}
+		record := query.auditRecord(AUDIT_EVENT_EXECUTION, stripAttributionComment(aws.StringValue(e.Query)), aws.StringValue(id))
+		if e.WorkGroup != nil {
+			record.WorkGroup = *e.WorkGroup
+		}
+		if e.Statistics != nil {
+			record.DataScannedBytes = e.Statistics.DataScannedInBytes
+		}
+		if e.Status != nil {
+			record.State = aws.StringValue(e.Status.State)
+			if e.Status.StateChangeReason != nil {
+				record.Error = *e.Status.StateChangeReason
+			}
+		}
+		query.audit.write(query.dsInfo, record)
+	}
+}
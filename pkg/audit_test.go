@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"gotest.tools/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	audit := newAuditLogger()
+	audit.dir = dir
+
+	query := &AwsAthenaQuery{
+		RefId:        "A",
+		Region:       "us-east-1",
+		WorkGroup:    "primary",
+		QueryString:  "SELECT 1",
+		PanelId:      2,
+		orgID:        1,
+		user:         "alice",
+		datasourceID: 3,
+		audit:        audit,
+		dsInfo:       &DatasourceInfo{AuditLogSink: AUDIT_LOG_SINK_FILE, AuditLogPath: "audit.log"},
+	}
+	query.auditExecutions([]*string{aws.String("id1"), aws.String("id2")}, []*athena.QueryExecution{{
+		QueryExecutionId: aws.String("id1"),
+		Query:            aws.String("SELECT 1"),
+		WorkGroup:        aws.String("primary"),
+		Statistics:       &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(100)},
+		Status:           &athena.QueryExecutionStatus{State: aws.String("SUCCEEDED")},
+	}})
+
+	b, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	var record auditRecord
+	assert.Equal(t, nil, json.Unmarshal([]byte(lines[0]), &record))
+	assert.Equal(t, AUDIT_EVENT_EXECUTION, record.Event)
+	assert.Equal(t, "alice", record.User)
+	assert.Equal(t, int64(1), record.OrgID)
+	assert.Equal(t, int64(2), record.PanelID)
+	assert.Equal(t, queryHash("SELECT 1"), record.QueryHash)
+	assert.Equal(t, int64(100), *record.DataScannedBytes)
+	assert.Equal(t, "SUCCEEDED", record.State)
+
+	assert.Equal(t, nil, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "id2", record.ExecutionID)
+	assert.Equal(t, "UNKNOWN", record.State)
+}
+
+func TestAuditLogPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	audit := newAuditLogger()
+	audit.dir = ""
+	_, err = audit.filePath("audit.log")
+	assert.Error(t, err, "file audit log sink requires GF_PLUGIN_ATHENA_AUDIT_LOG_DIR environment variable")
+
+	audit.dir = dir
+	path, err := audit.filePath("audit.log")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(dir, "audit.log"), path)
+	for _, name := range []string{"", ".", "..", "../audit.log", "/etc/passwd", "logs/audit.log"} {
+		_, err = audit.filePath(name)
+		assert.ErrorContains(t, err, "audit log path should be a file name in the audit log directory")
+	}
+
+	record := auditRecord{Event: AUDIT_EVENT_CACHE_HIT, DatasourceID: 1}
+	assert.Equal(t, nil, audit.writeFile(1, "audit.log", record))
+	assert.Equal(t, 1, len(audit.files))
+	audit.close(1)
+	assert.Equal(t, 0, len(audit.files))
+
+	// the file is opened again after the datasource is updated
+	assert.Equal(t, nil, audit.writeFile(1, "audit.log", record))
+	b, err := ioutil.ReadFile(path)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(strings.Split(strings.TrimSpace(string(b)), "\n")))
+	audit.close(1)
+}
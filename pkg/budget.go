@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+)
+
+const (
+	BUDGET_EXCEEDED_ACTION_REFUSE = "refuse"
+	BUDGET_EXCEEDED_ACTION_CACHE  = "cache"
+)
+
+const (
+	// pending query executions are checked in this interval, to record the executions which complete after the wait
+	BUDGET_SWEEP_INTERVAL = 1 * time.Minute
+	// pending query executions are dropped after this duration
+	BUDGET_PENDING_TTL = 24 * time.Hour
+)
+
+// scanBudget tracks the scanned bytes of the posted queries per datasource and per Grafana user.
+// The usage is reset at 00:00 UTC.
+type scanBudget struct {
+	lock        sync.Mutex
+	day         string
+	datasources map[int64]int64
+	users       map[string]int64
+	pending     map[string]pendingExecution
+	now         func() time.Time
+}
+
+// pendingExecution is the query execution started by the plugin, which scanned bytes are not recorded yet.
+type pendingExecution struct {
+	datasourceID int64
+	user         string
+	client       athenaiface.AthenaAPI
+	started      time.Time
+}
+
+func newScanBudget() *scanBudget {
+	return &scanBudget{
+		datasources: make(map[int64]int64),
+		users:       make(map[string]int64),
+		pending:     make(map[string]pendingExecution),
+		now:         time.Now,
+	}
+}
+
+func budgetUserKey(datasourceID int64, user string) string {
+	return strconv.FormatInt(datasourceID, 10) + "/" + user
+}
+
+// reset clears the usage of the previous day, the lock should be held by the caller.
+func (b *scanBudget) reset() {
+	day := b.now().UTC().Format("2006-01-02")
+	if b.day != day {
+		b.day = day
+		b.datasources = make(map[int64]int64)
+		b.users = make(map[string]int64)
+	}
+}
+
+func (b *scanBudget) add(datasourceID int64, user string, bytes int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.reset()
+	b.datasources[datasourceID] += bytes
+	if user != "" {
+		b.users[budgetUserKey(datasourceID, user)] += bytes
+	}
+}
+
+// track registers the started query execution, the scanned bytes are recorded when it completes.
+func (b *scanBudget) track(queryExecutionID string, datasourceID int64, user string, client athenaiface.AthenaAPI) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.pending[queryExecutionID] = pendingExecution{
+		datasourceID: datasourceID,
+		user:         user,
+		client:       client,
+		started:      b.now(),
+	}
+}
+
+func (b *scanBudget) isPending(queryExecutionID string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	_, ok := b.pending[queryExecutionID]
+	return ok
+}
+
+// complete records the scanned bytes of the completed query execution.
+// It returns true only for the first call of the tracked query execution, wherever the completion is seen.
+func (b *scanBudget) complete(e *athena.QueryExecution) bool {
+	if !isExecutionCompleted(e) {
+		return false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	p, ok := b.pending[aws.StringValue(e.QueryExecutionId)]
+	if !ok {
+		return false
+	}
+	delete(b.pending, aws.StringValue(e.QueryExecutionId))
+	if e.Statistics != nil && e.Statistics.DataScannedInBytes != nil {
+		b.reset()
+		b.datasources[p.datasourceID] += *e.Statistics.DataScannedInBytes
+		if p.user != "" {
+			b.users[budgetUserKey(p.datasourceID, p.user)] += *e.Statistics.DataScannedInBytes
+		}
+	}
+	return true
+}
+
+func (b *scanBudget) sweepLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		b.sweep(ctx)
+		cancel()
+	}
+}
+
+// sweep records the pending query executions which completed after the query stopped waiting for them.
+func (b *scanBudget) sweep(ctx context.Context) {
+	b.lock.Lock()
+	groups := make(map[athenaiface.AthenaAPI][]*string)
+	for id, p := range b.pending {
+		if b.now().Sub(p.started) > BUDGET_PENDING_TTL {
+			delete(b.pending, id)
+			continue
+		}
+		groups[p.client] = append(groups[p.client], aws.String(id))
+	}
+	b.lock.Unlock()
+
+	for client, ids := range groups {
+		for i := 0; i < len(ids); i += AWS_API_RESULT_MAX_LENGTH {
+			e := int(math.Min(float64(i+AWS_API_RESULT_MAX_LENGTH), float64(len(ids))))
+			bo, err := client.BatchGetQueryExecutionWithContext(ctx, &athena.BatchGetQueryExecutionInput{QueryExecutionIds: ids[i:e]})
+			if err != nil {
+				backend.Logger.Warn("Failed to get pending query executions", "error", err.Error())
+				continue
+			}
+			for _, e := range bo.QueryExecutions {
+				b.complete(e)
+			}
+		}
+	}
+}
+
+func (b *scanBudget) usage(datasourceID int64, user string) (int64, int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.reset()
+	return b.datasources[datasourceID], b.users[budgetUserKey(datasourceID, user)]
+}
+
+// check returns error when the usage of today reaches the budget, zero budget is unlimited.
+func (b *scanBudget) check(datasourceID int64, user string, datasourceBudget int64, userBudget int64) error {
+	datasourceUsage, userUsage := b.usage(datasourceID, user)
+	if datasourceBudget > 0 && datasourceUsage >= datasourceBudget {
+		return fmt.Errorf("daily scanned bytes budget of the datasource is exceeded: scanned %d bytes of %d bytes budget (resets at 00:00 UTC)", datasourceUsage, datasourceBudget)
+	}
+	if userBudget > 0 && user != "" && userUsage >= userBudget {
+		return fmt.Errorf("daily scanned bytes budget of user %s is exceeded: scanned %d bytes of %d bytes budget (resets at 00:00 UTC)", user, userUsage, userBudget)
+	}
+	return nil
+}
+
+// checkBudget checks the scan budget before starting the query execution.
+// With the cache action, the cached query execution is still served after the budget is exceeded.
+func (query *AwsAthenaQuery) checkBudget(cached bool) error {
+	if query.budget == nil {
+		return nil
+	}
+	err := query.budget.check(query.datasourceID, query.user, query.dsInfo.DailyScannedBytesBudget, query.dsInfo.UserDailyScannedBytesBudget)
+	if err == nil {
+		return nil
+	}
+	switch query.dsInfo.BudgetExceededAction {
+	case "", BUDGET_EXCEEDED_ACTION_REFUSE:
+		return err
+	case BUDGET_EXCEEDED_ACTION_CACHE:
+		if cached {
+			return nil
+		}
+		return fmt.Errorf("%s, only cached results are served", err.Error())
+	default:
+		return fmt.Errorf("unknown budget exceeded action: %s", query.dsInfo.BudgetExceededAction)
+	}
+}
+
+type scanBudgetUsage struct {
+	Date                        string `json:"date"`
+	DatasourceScannedBytes      int64  `json:"datasourceScannedBytes"`
+	DailyScannedBytesBudget     int64  `json:"dailyScannedBytesBudget"`
+	User                        string `json:"user"`
+	UserScannedBytes            int64  `json:"userScannedBytes"`
+	UserDailyScannedBytesBudget int64  `json:"userDailyScannedBytesBudget"`
+}
+
+func (ds *AwsAthenaDatasource) handleResourceScanBudget(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	dsInfo, err := ds.getDsInfo(pluginContext, "default")
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	user := ""
+	if pluginContext.User != nil {
+		user = pluginContext.User.Login
+	}
+
+	datasourceUsage, userUsage := ds.budget.usage(pluginContext.DataSourceInstanceSettings.ID, user)
+	writeResult(rw, "scan_budget", scanBudgetUsage{
+		Date:                        ds.budget.now().UTC().Format("2006-01-02"),
+		DatasourceScannedBytes:      datasourceUsage,
+		DailyScannedBytesBudget:     dsInfo.DailyScannedBytesBudget,
+		User:                        user,
+		UserScannedBytes:            userUsage,
+		UserDailyScannedBytesBudget: dsInfo.UserDailyScannedBytesBudget,
+	}, nil)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/athena/athenaiface"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+type fakeBatchGetClient struct {
+	athenaiface.AthenaAPI
+	executions map[string]*athena.QueryExecution
+	calls      int
+}
+
+func (c *fakeBatchGetClient) BatchGetQueryExecutionWithContext(ctx aws.Context, input *athena.BatchGetQueryExecutionInput, opts ...request.Option) (*athena.BatchGetQueryExecutionOutput, error) {
+	c.calls++
+	out := &athena.BatchGetQueryExecutionOutput{}
+	for _, id := range input.QueryExecutionIds {
+		if e, ok := c.executions[*id]; ok {
+			out.QueryExecutions = append(out.QueryExecutions, e)
+		}
+	}
+	return out, nil
+}
+
+func newTestExecution(id string, state string, scannedBytes int64) *athena.QueryExecution {
+	return &athena.QueryExecution{
+		QueryExecutionId: aws.String(id),
+		Query:            aws.String("SELECT 1"),
+		Status:           &athena.QueryExecutionStatus{State: aws.String(state)},
+		Statistics:       &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(scannedBytes)},
+	}
+}
+
+func TestScanBudget(t *testing.T) {
+	now := time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC)
+	budget := newScanBudget()
+	budget.now = func() time.Time { return now }
+
+	budget.add(1, "alice", 600)
+	budget.add(1, "bob", 300)
+	assert.Equal(t, nil, budget.check(1, "alice", 1000, 1000))
+	assert.Error(t, budget.check(1, "alice", 1000, 500), "daily scanned bytes budget of user alice is exceeded: scanned 600 bytes of 500 bytes budget (resets at 00:00 UTC)")
+	assert.Equal(t, nil, budget.check(1, "bob", 1000, 500))
+
+	budget.add(1, "", 100)
+	assert.ErrorContains(t, budget.check(1, "bob", 1000, 500), "budget of the datasource is exceeded")
+	assert.Equal(t, nil, budget.check(2, "bob", 1000, 500))
+
+	query := &AwsAthenaQuery{budget: budget, datasourceID: 1, user: "bob", dsInfo: &DatasourceInfo{DailyScannedBytesBudget: 1000, BudgetExceededAction: BUDGET_EXCEEDED_ACTION_CACHE}}
+	assert.Equal(t, nil, query.checkBudget(true))
+	assert.ErrorContains(t, query.checkBudget(false), "only cached results are served")
+
+	now = now.Add(2 * time.Hour)
+	assert.Equal(t, nil, budget.check(1, "alice", 1000, 500))
+}
+
+func TestScanBudgetCompletedAfterWait(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	budget := newScanBudget()
+	budget.now = func() time.Time { return now }
+	client := &fakeBatchGetClient{executions: map[string]*athena.QueryExecution{
+		"running": newTestExecution("running", athena.QueryExecutionStateRunning, 0),
+	}}
+	query := &AwsAthenaQuery{budget: budget, cache: newQueryCache(time.Minute, time.Minute), metrics: newAwsAthenaMetrics(), datasourceID: 1, user: "alice", dsInfo: &DatasourceInfo{}}
+
+	// the query stops waiting while the execution is running
+	budget.track("running", 1, "alice", client)
+	assert.Assert(t, !query.completeExecution(client.executions["running"]))
+	budget.sweep(context.Background())
+	dsUsage, _ := budget.usage(1, "")
+	assert.Equal(t, int64(0), dsUsage)
+	assert.Assert(t, budget.isPending("running"))
+
+	// the execution completes after the wait, and the scanned bytes are recorded by the sweep
+	client.executions["running"] = newTestExecution("running", athena.QueryExecutionStateSucceeded, 700)
+	budget.sweep(context.Background())
+	dsUsage, userUsage := budget.usage(1, "alice")
+	assert.Equal(t, int64(700), dsUsage)
+	assert.Equal(t, int64(700), userUsage)
+	assert.Assert(t, !budget.isPending("running"))
+
+	// the completion seen later by the query or the async poll is not recorded twice
+	assert.Assert(t, !query.completeExecution(client.executions["running"]))
+	budget.sweep(context.Background())
+	dsUsage, _ = budget.usage(1, "alice")
+	assert.Equal(t, int64(700), dsUsage)
+
+	// the completion seen first by the query is recorded, the sweep doesn't add it again
+	budget.track("polled", 1, "alice", client)
+	client.executions["polled"] = newTestExecution("polled", athena.QueryExecutionStateSucceeded, 300)
+	assert.Assert(t, query.completeExecution(client.executions["polled"]))
+	budget.sweep(context.Background())
+	_, userUsage = budget.usage(1, "alice")
+	assert.Equal(t, int64(1000), userUsage)
+
+	// the execution which never completes is dropped after the TTL
+	budget.track("stuck", 1, "alice", client)
+	now = now.Add(BUDGET_PENDING_TTL + time.Minute)
+	calls := client.calls
+	budget.sweep(context.Background())
+	assert.Assert(t, !budget.isPending("stuck"))
+	assert.Equal(t, calls, client.calls)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/context"
+)
+
+// queryCache wraps go-cache to keep per entry statistics (creation time, size and hit count),
+// so that cache entries can be inspected and invalidated through resource API.
+type queryCache struct {
+	*cache.Cache
+	statsLock sync.Mutex
+	stats     map[string]*cacheEntryStats
+}
+
+type cacheEntryStats struct {
+	created time.Time
+	size    int
+	hits    int64
+}
+
+type cacheEntry struct {
+	Key           string    `json:"key"`
+	Type          string    `json:"type"`
+	Region        string    `json:"region"`
+	AssumeRoleArn string    `json:"assumeRoleArn,omitempty"`
+	ExecutionID   string    `json:"executionId,omitempty"`
+	QueryHash     string    `json:"queryHash,omitempty"`
+	Size          int       `json:"size"`
+	Age           string    `json:"age"`
+	Created       time.Time `json:"created"`
+	Expiration    time.Time `json:"expiration"`
+	Hits          int64     `json:"hits"`
+}
+
+func newQueryCache(defaultExpiration, cleanupInterval time.Duration) *queryCache {
+	c := &queryCache{
+		Cache: cache.New(defaultExpiration, cleanupInterval),
+		stats: make(map[string]*cacheEntryStats),
+	}
+	c.OnEvicted(func(key string, _ interface{}) {
+		c.statsLock.Lock()
+		delete(c.stats, key)
+		c.statsLock.Unlock()
+	})
+	return c
+}
+
+func (c *queryCache) Set(key string, value interface{}, d time.Duration) {
+	c.Cache.Set(key, value, d)
+	c.statsLock.Lock()
+	c.stats[key] = &cacheEntryStats{
+		created: time.Now(),
+		size:    cacheValueSize(value),
+	}
+	c.statsLock.Unlock()
+}
+
+func (c *queryCache) GetWithExpiration(key string) (interface{}, time.Time, bool) {
+	value, expiration, found := c.Cache.GetWithExpiration(key)
+	if found {
+		c.statsLock.Lock()
+		if s, ok := c.stats[key]; ok {
+			s.hits++
+		}
+		c.statsLock.Unlock()
+	}
+	return value, expiration, found
+}
+
+// entries returns the cache entries which belong to the datasource, sorted by key.
+func (c *queryCache) entries(datasourceID int64) []cacheEntry {
+	result := make([]cacheEntry, 0)
+	now := time.Now()
+	for key, item := range c.Items() {
+		entry, ok := parseCacheKey(key, datasourceID)
+		if !ok {
+			continue
+		}
+		if id, ok := item.Object.(string); ok && entry.Type == "StartQueryExecution" {
+			entry.ExecutionID = id
+		}
+		if item.Expiration > 0 {
+			entry.Expiration = time.Unix(0, item.Expiration)
+		}
+		c.statsLock.Lock()
+		if s, ok := c.stats[key]; ok {
+			entry.Created = s.created
+			entry.Age = now.Sub(s.created).Truncate(time.Second).String()
+			entry.Size = s.size
+			entry.Hits = s.hits
+		}
+		c.statsLock.Unlock()
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// invalidate deletes the cache entries of the datasource which match the filter, and returns deleted keys.
+func (c *queryCache) invalidate(datasourceID int64, filter func(entry cacheEntry) bool) []string {
+	deleted := make([]string, 0)
+	for _, entry := range c.entries(datasourceID) {
+		if filter(entry) {
+			c.Delete(entry.Key)
+			deleted = append(deleted, entry.Key)
+		}
+	}
+	return deleted
+}
+
+// parseCacheKey parses the "<Type>/<datasource id>/<region>/..." style cache key.
+func parseCacheKey(key string, datasourceID int64) (cacheEntry, bool) {
+	parts := strings.SplitN(key, "/", 4)
+	if len(parts) < 3 || parts[1] != strconv.FormatInt(datasourceID, 10) {
+		return cacheEntry{}, false
+	}
+	entry := cacheEntry{
+		Key:    key,
+		Type:   parts[0],
+		Region: parts[2],
+	}
+	// per query role is appended to the region, see AwsAthenaQuery.cacheScope()
+	if i := strings.Index(entry.Region, "@"); i != -1 {
+		if arn, err := url.PathUnescape(entry.Region[i+1:]); err == nil {
+			entry.AssumeRoleArn = arn
+		}
+		entry.Region = entry.Region[:i]
+	}
+	if len(parts) < 4 {
+		return entry, true
+	}
+	switch entry.Type {
+	case "QueryResults":
+		// QueryResults/<datasource id>/<region>/<query execution id>/<max rows>
+		if i := strings.LastIndex(parts[3], "/"); i != -1 {
+			entry.ExecutionID = parts[3][:i]
+		}
+	case "StartQueryExecution":
+		// StartQueryExecution/<datasource id>/<region>/<query string>/<max rows>
+		if i := strings.LastIndex(parts[3], "/"); i != -1 {
+			entry.QueryHash = queryHash(parts[3][:i])
+		}
+	case "ScannedBytes":
+		// ScannedBytes/<datasource id>/<region>/<query hash>
+		entry.QueryHash = parts[3]
+	case "VariableQuery":
+		// VariableQuery/<datasource id>/<region>/<hash of query and time range>
+		entry.QueryHash = parts[3]
+	case "PartitionValues":
+		// PartitionValues/<datasource id>/<region>/<hash of table, key, expression and order>
+		entry.QueryHash = parts[3]
+	}
+	return entry, true
+}
+
+func queryHash(queryString string) string {
+	sum := sha256.Sum256([]byte(queryString))
+	return hex.EncodeToString(sum[:])
+}
+
+func cacheValueSize(value interface{}) int {
+	if s, ok := value.(string); ok {
+		return len(s)
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+func (ds *AwsAthenaDatasource) handleResourceCacheEntries(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+
+	writeResult(rw, "cache_entries", ds.cache.entries(pluginContext.DataSourceInstanceSettings.ID), nil)
+}
+
+func (ds *AwsAthenaDatasource) handleResourceInvalidateCache(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	datasourceID := pluginContext.DataSourceInstanceSettings.ID
+	urlQuery := req.URL.Query()
+	prefix := urlQuery.Get("prefix")
+	executionID := urlQuery.Get("executionId")
+	hash := urlQuery.Get("queryHash")
+	if prefix == "" && executionID == "" && hash == "" {
+		writeResult(rw, "?", nil, fmt.Errorf("prefix, executionId or queryHash should be set"))
+		return
+	}
+
+	// the results of the query are cached by query execution id, resolve them from the query hash
+	executionIDs := make(map[string]bool)
+	if executionID != "" {
+		executionIDs[executionID] = true
+	}
+	if hash != "" {
+		for _, entry := range ds.cache.entries(datasourceID) {
+			if entry.QueryHash == hash && entry.ExecutionID != "" {
+				executionIDs[entry.ExecutionID] = true
+			}
+		}
+	}
+
+	deleted := ds.cache.invalidate(datasourceID, func(entry cacheEntry) bool {
+		if prefix != "" && strings.HasPrefix(entry.Key, prefix) {
+			return true
+		}
+		if hash != "" && entry.QueryHash == hash {
+			return true
+		}
+		return executionIDs[entry.ExecutionID]
+	})
+
+	writeResult(rw, "invalidate_cache", deleted, nil)
+}
+
+type warmCacheRequest struct {
+	From    time.Time         `json:"from"`
+	To      time.Time         `json:"to"`
+	Range   Duration          `json:"range"`
+	Queries []json.RawMessage `json:"queries"`
+}
+
+type warmCacheResult struct {
+	RefId string `json:"refId"`
+	Error string `json:"error,omitempty"`
+}
+
+func (ds *AwsAthenaDatasource) handleResourceWarmCache(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+
+	var wr warmCacheRequest
+	if err := json.NewDecoder(req.Body).Decode(&wr); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	to := wr.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	from := wr.From
+	if from.IsZero() {
+		r := time.Duration(wr.Range)
+		if r == 0 {
+			r = time.Hour
+		}
+		from = to.Add(-r)
+	}
+
+	results, err := ds.warmCache(ctx, pluginContext, from, to, wr.Queries)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	writeResult(rw, "warm_cache", results, nil)
+}
+
+// warmCache runs the queries through QueryData, so that the results are stored to the cache.
+func (ds *AwsAthenaDatasource) warmCache(ctx context.Context, pluginContext backend.PluginContext, from time.Time, to time.Time, queries []json.RawMessage) ([]warmCacheResult, error) {
+	qdr := &backend.QueryDataRequest{
+		PluginContext: pluginContext,
+		Queries:       make([]backend.DataQuery, 0, len(queries)),
+	}
+	for _, q := range queries {
+		var target AwsAthenaQuery
+		if err := json.Unmarshal(q, &target); err != nil {
+			return nil, err
+		}
+		if target.CacheDuration <= 0 {
+			return nil, fmt.Errorf("cacheDuration should be set to warm cache: %s", target.RefId)
+		}
+		qdr.Queries = append(qdr.Queries, backend.DataQuery{
+			RefID:     target.RefId,
+			TimeRange: backend.TimeRange{From: from, To: to},
+			JSON:      q,
+		})
+	}
+
+	resp, err := ds.QueryData(ctx, qdr)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]warmCacheResult, 0, len(qdr.Queries))
+	for _, q := range qdr.Queries {
+		r := warmCacheResult{RefId: q.RefID}
+		if dr, ok := resp.Responses[q.RefID]; ok && dr.Error != nil {
+			r.Error = dr.Error.Error()
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
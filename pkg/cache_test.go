@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestQueryCache(t *testing.T) {
+	t.Run("entries", func(t *testing.T) {
+		c := newQueryCache(300*time.Second, 5*time.Second)
+		c.Set("StartQueryExecution/1/us-east-1/SELECT 1/1000", "exec-1", time.Minute)
+		c.Set("QueryResults/1/us-east-1/exec-1/1000", "result", time.Minute)
+		c.Set("QueryResults/2/us-east-1/exec-2/1000", "result", time.Minute)
+		c.GetWithExpiration("QueryResults/1/us-east-1/exec-1/1000")
+		c.GetWithExpiration("QueryResults/1/us-east-1/exec-1/1000")
+
+		entries := c.entries(1)
+		assert.Equal(t, 2, len(entries))
+		assert.Equal(t, "QueryResults", entries[0].Type)
+		assert.Equal(t, "exec-1", entries[0].ExecutionID)
+		assert.Equal(t, int64(2), entries[0].Hits)
+		assert.Equal(t, len("result"), entries[0].Size)
+		assert.Equal(t, "StartQueryExecution", entries[1].Type)
+		assert.Equal(t, "exec-1", entries[1].ExecutionID)
+		assert.Equal(t, queryHash("SELECT 1"), entries[1].QueryHash)
+	})
+
+	t.Run("invalidate", func(t *testing.T) {
+		c := newQueryCache(300*time.Second, 5*time.Second)
+		c.Set("QueryResults/1/us-east-1/exec-1/1000", "result", time.Minute)
+		c.Set("QueryResults/1/us-east-1/exec-2/1000", "result", time.Minute)
+		c.Set("QueryResults/2/us-east-1/exec-1/1000", "result", time.Minute)
+
+		deleted := c.invalidate(1, func(entry cacheEntry) bool {
+			return entry.ExecutionID == "exec-1"
+		})
+		assert.DeepEqual(t, []string{"QueryResults/1/us-east-1/exec-1/1000"}, deleted)
+		assert.Equal(t, 1, len(c.entries(1)))
+		assert.Equal(t, 1, len(c.entries(2)))
+	})
+}
@@ -3,32 +3,30 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/service/athena"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/defaults"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 )
 
-type credentialCache struct {
-	credential *credentials.Credentials
-	expiration *time.Time
-}
-
-var awsCredentialCache = make(map[string]credentialCache)
-var credentialCacheLock sync.RWMutex
-
 type DatasourceInfo struct {
 	Region        string
 	DefaultRegion string
@@ -36,98 +34,334 @@ type DatasourceInfo struct {
 	AuthType      string `json:"authType"`
 	AssumeRoleArn string `json:"assumeRoleArn"`
 
+	ExternalId            string   `json:"externalId"`
+	AssumeRoleDuration    Duration `json:"assumeRoleDuration"`
+	AssumeRoleSessionName string   `json:"assumeRoleSessionName"`
+	IntermediateRoleArn   string   `json:"intermediateRoleArn"`
+	AllowedAssumeRoleArns []string `json:"allowedAssumeRoleArns"`
+
+	AthenaEndpoint string `json:"athenaEndpoint"`
+	StsEndpoint    string `json:"stsEndpoint"`
+	Ec2Endpoint    string `json:"ec2Endpoint"`
+	S3Endpoint     string `json:"s3Endpoint"`
+	GlueEndpoint   string `json:"glueEndpoint"`
+	HTTPProxy      string `json:"httpProxy"`
+
+	OutputLocation string         `json:"outputLocation"`
+	PrewarmQueries []PrewarmQuery `json:"prewarmQueries"`
+	QueryRegions   []string       `json:"queryRegions"`
+
+	AllowDDL      bool     `json:"allowDdl"`
+	AllowDML      bool     `json:"allowDml"`
+	AllowedTables []string `json:"allowedTables"`
+
+	ScanLimitPolicy               string `json:"scanLimitPolicy"`
+	MaxBytesScannedCutoffPerQuery int64  `json:"maxBytesScannedCutoffPerQuery"`
+
+	DailyScannedBytesBudget     int64  `json:"dailyScannedBytesBudget"`
+	UserDailyScannedBytesBudget int64  `json:"userDailyScannedBytesBudget"`
+	BudgetExceededAction        string `json:"budgetExceededAction"`
+
+	ScanCostPerTerabyte float64 `json:"scanCostPerTerabyte"`
+
+	AuditLogSink string `json:"auditLogSink"`
+	AuditLogPath string `json:"auditLogPath"`
+
+	AttributionComment bool             `json:"attributionComment"`
+	WorkgroupRoutes    []WorkgroupRoute `json:"workgroupRoutes"`
+
 	AccessKey string
 	SecretKey string
+
+	OrgID          int64        `json:"-"`
+	DatasourceID   int64        `json:"-"`
+	DatasourceName string       `json:"-"`
+	HTTPClient     *http.Client `json:"-"`
 }
 
-func GetCredentials(dsInfo *DatasourceInfo) (*credentials.Credentials, error) {
-	cacheKey := dsInfo.AccessKey + ":" + dsInfo.Profile + ":" + dsInfo.AssumeRoleArn
-	credentialCacheLock.RLock()
-	if _, ok := awsCredentialCache[cacheKey]; ok {
-		if awsCredentialCache[cacheKey].expiration != nil &&
-			(*awsCredentialCache[cacheKey].expiration).After(time.Now().UTC()) {
-			result := awsCredentialCache[cacheKey].credential
-			credentialCacheLock.RUnlock()
-			return result, nil
+var invalidRoleSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// roleSessionName renders the session name template, orgId, datasourceId and datasourceName are available.
+func roleSessionName(dsInfo *DatasourceInfo) string {
+	if dsInfo.AssumeRoleSessionName == "" {
+		return "GrafanaSession"
+	}
+	name := formatLegend(map[string]string{
+		"orgId":          strconv.FormatInt(dsInfo.OrgID, 10),
+		"datasourceId":   strconv.FormatInt(dsInfo.DatasourceID, 10),
+		"datasourceName": dsInfo.DatasourceName,
+	}, dsInfo.AssumeRoleSessionName)
+	name = invalidRoleSessionNameChars.ReplaceAllString(name, "-")
+	// role session name should be 2-64 characters
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// withAssumeRole returns the copy of the settings to assume the per query role.
+// The role is assumed with the datasource credentials, or through the datasource role if the datasource assumes a role.
+func (dsInfo *DatasourceInfo) withAssumeRole(assumeRoleArn string) (*DatasourceInfo, error) {
+	allowed := false
+	for _, arn := range dsInfo.AllowedAssumeRoleArns {
+		if arn == assumeRoleArn {
+			allowed = true
+			break
 		}
 	}
-	credentialCacheLock.RUnlock()
+	if !allowed {
+		return nil, fmt.Errorf("assume role arn is not allowed in the datasource: %s", assumeRoleArn)
+	}
 
-	accessKeyId := ""
-	secretAccessKey := ""
-	sessionToken := ""
-	var expiration *time.Time = nil
+	roleInfo := *dsInfo
 	if dsInfo.AuthType == "arn" {
-		params := &sts.AssumeRoleInput{
-			RoleArn:         aws.String(dsInfo.AssumeRoleArn),
-			RoleSessionName: aws.String("GrafanaSession"),
-			DurationSeconds: aws.Int64(900),
+		if dsInfo.IntermediateRoleArn != "" {
+			return nil, fmt.Errorf("per query assume role can't be used with intermediate role")
 		}
+		roleInfo.IntermediateRoleArn = dsInfo.AssumeRoleArn
+	}
+	roleInfo.AuthType = "arn"
+	roleInfo.AssumeRoleArn = assumeRoleArn
+	return &roleInfo, nil
+}
 
-		stsSess, err := session.NewSession()
-		if err != nil {
-			return nil, err
-		}
-		stsCreds := credentials.NewChainCredentials(
-			[]credentials.Provider{
-				&credentials.EnvProvider{},
-				&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
-				remoteCredProvider(stsSess),
-			})
-		stsConfig := &aws.Config{
-			Region:      aws.String(dsInfo.Region),
-			Credentials: stsCreds,
-		}
+func assumeRoleDuration(dsInfo *DatasourceInfo) time.Duration {
+	if dsInfo.AssumeRoleDuration == 0 {
+		return 900 * time.Second
+	}
+	return time.Duration(dsInfo.AssumeRoleDuration)
+}
 
-		sess, err := session.NewSession(stsConfig)
-		if err != nil {
-			return nil, err
+// credentials expiring before the next check are refreshed in background, so requests don't wait for STS
+const CREDENTIALS_REFRESH_INTERVAL = 1 * time.Minute
+
+// credentialsCache keeps the credentials for each combination of the settings which affect credentials.
+// The expiry of the credentials is moved forward by the providers' expiry window, and refreshLoop refreshes
+// the credentials before that. Entries are evicted when the datasource instance is disposed.
+type credentialsCache struct {
+	lock      sync.Mutex
+	entries   map[string]*credentials.Credentials
+	providers func(dsInfo *DatasourceInfo) ([]credentials.Provider, error)
+	metrics   *credentialsMetrics
+}
+
+type credentialsMetrics struct {
+	refreshTotal         *prometheus.CounterVec
+	refreshFailuresTotal *prometheus.CounterVec
+}
+
+func newCredentialsMetrics() *credentialsMetrics {
+	return &credentialsMetrics{
+		refreshTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "credentials_refresh_total",
+				Help:      "credentials refresh counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"auth_type", "provider"},
+		),
+		refreshFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "credentials_refresh_failures_total",
+				Help:      "credentials refresh failure counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"auth_type"},
+		),
+	}
+}
+
+var defaultCredentialsCache = newCredentialsCache(credentialProviders, newCredentialsMetrics())
+
+func newCredentialsCache(providers func(dsInfo *DatasourceInfo) ([]credentials.Provider, error), metrics *credentialsMetrics) *credentialsCache {
+	return &credentialsCache{
+		entries:   make(map[string]*credentials.Credentials),
+		providers: providers,
+		metrics:   metrics,
+	}
+}
+
+func GetCredentials(dsInfo *DatasourceInfo) (*credentials.Credentials, error) {
+	return defaultCredentialsCache.get(dsInfo)
+}
+
+func (c *credentialsCache) get(dsInfo *DatasourceInfo) (*credentials.Credentials, error) {
+	cacheKey := credentialsCacheKey(dsInfo)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if creds, ok := c.entries[cacheKey]; ok {
+		return creds, nil
+	}
+
+	providers, err := c.providers(dsInfo)
+	if err != nil {
+		return nil, err
+	}
+	creds := credentials.NewCredentials(&instrumentedProvider{
+		providers: providers,
+		authType:  dsInfo.AuthType,
+		metrics:   c.metrics,
+	})
+	c.entries[cacheKey] = creds
+	return creds, nil
+}
+
+func (c *credentialsCache) evict(cacheKeys []string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, key := range cacheKeys {
+		delete(c.entries, key)
+	}
+}
+
+func (c *credentialsCache) refreshLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.refreshExpiring(time.Now().Add(interval))
+	}
+}
+
+// refreshExpiring refreshes the retrieved credentials which expire before the deadline.
+func (c *credentialsCache) refreshExpiring(deadline time.Time) {
+	c.lock.Lock()
+	entries := make([]*credentials.Credentials, 0, len(c.entries))
+	for _, creds := range c.entries {
+		entries = append(entries, creds)
+	}
+	c.lock.Unlock()
+
+	for _, creds := range entries {
+		expiresAt, err := creds.ExpiresAt()
+		// zero time when the credentials are not retrieved yet or never expire
+		if err != nil || expiresAt.IsZero() || expiresAt.After(deadline) {
+			continue
 		}
-		svc := sts.New(sess, stsConfig)
-		resp, err := svc.AssumeRole(params)
-		if err != nil {
-			return nil, err
+		creds.Expire()
+		if _, err := creds.Get(); err != nil {
+			backend.Logger.Warn("Failed to refresh credentials", "error", err.Error())
 		}
-		if resp.Credentials != nil {
-			accessKeyId = *resp.Credentials.AccessKeyId
-			secretAccessKey = *resp.Credentials.SecretAccessKey
-			sessionToken = *resp.Credentials.SessionToken
-			expiration = resp.Credentials.Expiration
+	}
+}
+
+// credentialsCacheKey is composed of every setting which affects credentials, the secret key is hashed.
+func credentialsCacheKey(dsInfo *DatasourceInfo) string {
+	secretKeyHash := ""
+	if dsInfo.SecretKey != "" {
+		secretKeyHash = queryHash(dsInfo.SecretKey)
+	}
+	return strings.Join([]string{
+		dsInfo.AuthType,
+		dsInfo.Region,
+		dsInfo.Profile,
+		dsInfo.AccessKey,
+		secretKeyHash,
+		dsInfo.AssumeRoleArn,
+		dsInfo.ExternalId,
+		dsInfo.IntermediateRoleArn,
+		roleSessionName(dsInfo),
+		assumeRoleDuration(dsInfo).String(),
+		dsInfo.StsEndpoint,
+		dsInfo.HTTPProxy,
+	}, ":")
+}
+
+// instrumentedProvider is the chain of the providers which counts the credentials refreshes and failures.
+// Unlike credentials.ChainProvider, it exposes the expiry of the current provider.
+type instrumentedProvider struct {
+	providers []credentials.Provider
+	curr      credentials.Provider
+	authType  string
+	metrics   *credentialsMetrics
+}
+
+func (p *instrumentedProvider) Retrieve() (credentials.Value, error) {
+	for _, provider := range p.providers {
+		v, err := provider.Retrieve()
+		if err == nil {
+			p.curr = provider
+			p.metrics.refreshTotal.With(prometheus.Labels{"auth_type": p.authType, "provider": v.ProviderName}).Inc()
+			return v, nil
 		}
-	} else {
-		now := time.Now()
-		e := now.Add(5 * time.Minute)
-		expiration = &e
 	}
+	p.curr = nil
+	p.metrics.refreshFailuresTotal.With(prometheus.Labels{"auth_type": p.authType}).Inc()
+	return credentials.Value{}, credentials.ErrNoValidProvidersFoundInChain
+}
 
+func (p *instrumentedProvider) IsExpired() bool {
+	if p.curr == nil {
+		return true
+	}
+	return p.curr.IsExpired()
+}
+
+// ExpiresAt returns the expiry of the current provider, zero time if it doesn't expire.
+func (p *instrumentedProvider) ExpiresAt() time.Time {
+	if e, ok := p.curr.(credentials.Expirer); ok {
+		return e.ExpiresAt()
+	}
+	return time.Time{}
+}
+
+func credentialProviders(dsInfo *DatasourceInfo) ([]credentials.Provider, error) {
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
 	}
-	creds := credentials.NewChainCredentials(
-		[]credentials.Provider{
-			&credentials.StaticProvider{Value: credentials.Value{
-				AccessKeyID:     accessKeyId,
-				SecretAccessKey: secretAccessKey,
-				SessionToken:    sessionToken,
-			}},
-			&credentials.EnvProvider{},
-			&credentials.StaticProvider{Value: credentials.Value{
-				AccessKeyID:     dsInfo.AccessKey,
-				SecretAccessKey: dsInfo.SecretKey,
-			}},
-			&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
-			remoteCredProvider(sess),
-		})
 
-	credentialCacheLock.Lock()
-	awsCredentialCache[cacheKey] = credentialCache{
-		credential: creds,
-		expiration: expiration,
+	switch dsInfo.AuthType {
+	case "arn":
+		stsCreds := credentials.NewChainCredentials(defaultCredentialProviders(sess, dsInfo))
+		if dsInfo.IntermediateRoleArn != "" {
+			// role chaining, assume the intermediate role before assuming the target role
+			stsCreds = credentials.NewCredentials(&stscreds.AssumeRoleProvider{
+				Client:          sts.New(sess, newStsConfig(dsInfo).WithCredentials(stsCreds)),
+				RoleARN:         dsInfo.IntermediateRoleArn,
+				RoleSessionName: roleSessionName(dsInfo),
+				Duration:        stscreds.DefaultDuration,
+				ExpiryWindow:    1 * time.Minute,
+			})
+		}
+		p := &stscreds.AssumeRoleProvider{
+			Client:          sts.New(sess, newStsConfig(dsInfo).WithCredentials(stsCreds)),
+			RoleARN:         dsInfo.AssumeRoleArn,
+			RoleSessionName: roleSessionName(dsInfo),
+			Duration:        assumeRoleDuration(dsInfo),
+			ExpiryWindow:    5 * time.Minute,
+		}
+		if dsInfo.ExternalId != "" {
+			p.ExternalID = aws.String(dsInfo.ExternalId)
+		}
+		return []credentials.Provider{p}, nil
+	case "web_identity":
+		return []credentials.Provider{
+			webIdentityProvider(sess, dsInfo),
+		}, nil
+	case "sso":
+		return []credentials.Provider{
+			&ssoProvider{profile: dsInfo.Profile},
+		}, nil
 	}
-	credentialCacheLock.Unlock()
 
-	return creds, nil
+	return defaultCredentialProviders(sess, dsInfo), nil
+}
+
+func defaultCredentialProviders(sess *session.Session, dsInfo *DatasourceInfo) []credentials.Provider {
+	providers := []credentials.Provider{
+		&credentials.EnvProvider{},
+		&credentials.StaticProvider{Value: credentials.Value{
+			AccessKeyID:     dsInfo.AccessKey,
+			SecretAccessKey: dsInfo.SecretKey,
+		}},
+		&credentials.SharedCredentialsProvider{Filename: "", Profile: dsInfo.Profile},
+	}
+	if dsInfo.Profile != "" {
+		providers = append(providers, &ssoProvider{profile: dsInfo.Profile})
+	}
+	providers = append(providers,
+		webIdentityProvider(sess, dsInfo),
+		remoteCredProvider(sess),
+	)
+	return providers
 }
 
 func remoteCredProvider(sess *session.Session) credentials.Provider {
@@ -154,28 +388,108 @@ func ec2RoleProvider(sess *session.Session) credentials.Provider {
 	return &ec2rolecreds.EC2RoleProvider{Client: ec2metadata.New(sess), ExpiryWindow: 5 * time.Minute}
 }
 
-func (t *AwsAthenaDatasource) getDsInfo(datasourceInfo *backend.DataSourceInstanceSettings, region string) (*DatasourceInfo, error) {
+// webIdentityProvider returns the provider to exchange the web identity token (e.g. EKS IAM roles for service accounts) for credentials.
+func webIdentityProvider(sess *session.Session, dsInfo *DatasourceInfo) credentials.Provider {
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	roleArn := os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleArn == "" {
+		return &unavailableProvider{
+			providerName: stscreds.WebIdentityProviderName,
+			err:          fmt.Errorf("AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN should be set"),
+		}
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = "GrafanaSession"
+	}
+	svc := sts.New(sess, newStsConfig(dsInfo))
+	p := stscreds.NewWebIdentityRoleProvider(svc, roleArn, sessionName, tokenFile)
+	p.ExpiryWindow = 5 * time.Minute
+	return p
+}
+
+// ssoProvider retrieves credentials of the AWS SSO configured profile in the shared config file.
+type ssoProvider struct {
+	profile string
+	creds   *credentials.Credentials
+}
+
+func (p *ssoProvider) Retrieve() (credentials.Value, error) {
+	if p.creds == nil {
+		sess, err := session.NewSessionWithOptions(session.Options{
+			Profile:           p.profile,
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return credentials.Value{ProviderName: ssocreds.ProviderName}, err
+		}
+		p.creds = sess.Config.Credentials
+	}
+	v, err := p.creds.Get()
+	if err != nil {
+		return credentials.Value{ProviderName: ssocreds.ProviderName}, err
+	}
+	if v.ProviderName != ssocreds.ProviderName {
+		return credentials.Value{ProviderName: ssocreds.ProviderName}, fmt.Errorf("profile %s is not configured for AWS SSO", p.profile)
+	}
+	return v, nil
+}
+
+func (p *ssoProvider) IsExpired() bool {
+	return p.creds == nil || p.creds.IsExpired()
+}
+
+func (p *ssoProvider) ExpiresAt() time.Time {
+	if p.creds == nil {
+		return time.Time{}
+	}
+	t, _ := p.creds.ExpiresAt()
+	return t
+}
+
+// unavailableProvider is a placeholder of the provider which is not configured in the environment.
+type unavailableProvider struct {
+	providerName string
+	err          error
+}
+
+func (p *unavailableProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{ProviderName: p.providerName}, p.err
+}
+
+func (p *unavailableProvider) IsExpired() bool {
+	return true
+}
+
+func newDsInfo(settings *backend.DataSourceInstanceSettings) (*DatasourceInfo, error) {
 	var dsInfo DatasourceInfo
-	if err := json.Unmarshal([]byte(datasourceInfo.JSONData), &dsInfo); err != nil {
+	if err := json.Unmarshal([]byte(settings.JSONData), &dsInfo); err != nil {
 		return nil, err
 	}
 
-	if region == "default" || region == "" {
-		dsInfo.Region = dsInfo.DefaultRegion
-	} else {
-		dsInfo.Region = region
+	dsInfo.Region = dsInfo.DefaultRegion
+	dsInfo.DatasourceID = settings.ID
+	dsInfo.DatasourceName = settings.Name
+	if dsInfo.HTTPProxy != "" {
+		proxyURL, err := url.Parse(dsInfo.HTTPProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy: %s", err.Error())
+		}
+		dsInfo.HTTPClient = &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		}
 	}
-	if v, ok := datasourceInfo.DecryptedSecureJSONData["accessKey"]; ok {
+	if v, ok := settings.DecryptedSecureJSONData["accessKey"]; ok {
 		dsInfo.AccessKey = v
 	}
-	if v, ok := datasourceInfo.DecryptedSecureJSONData["secretKey"]; ok {
+	if v, ok := settings.DecryptedSecureJSONData["secretKey"]; ok {
 		dsInfo.SecretKey = v
 	}
 
 	return &dsInfo, nil
 }
 
-func (t *AwsAthenaDatasource) getAwsConfig(dsInfo *DatasourceInfo) (*aws.Config, error) {
+func getAwsConfig(dsInfo *DatasourceInfo) (*aws.Config, error) {
 	creds, err := GetCredentials(dsInfo)
 	if err != nil {
 		return nil, err
@@ -185,43 +499,26 @@ func (t *AwsAthenaDatasource) getAwsConfig(dsInfo *DatasourceInfo) (*aws.Config,
 		Region:      aws.String(dsInfo.Region),
 		Credentials: creds,
 	}
+	if dsInfo.HTTPClient != nil {
+		cfg.HTTPClient = dsInfo.HTTPClient
+	}
 	return cfg, nil
 }
 
-func (t *AwsAthenaDatasource) getClient(datasourceInfo *backend.DataSourceInstanceSettings, region string) (*athena.Athena, error) {
-	dsInfo, err := t.getDsInfo(datasourceInfo, region)
-	if err != nil {
-		return nil, err
-	}
-	cfg, err := t.getAwsConfig(dsInfo)
-	if err != nil {
-		return nil, err
+func newStsConfig(dsInfo *DatasourceInfo) *aws.Config {
+	cfg := &aws.Config{
+		Region: aws.String(dsInfo.Region),
 	}
-
-	sess, err := session.NewSession(cfg)
-	if err != nil {
-		return nil, err
+	if dsInfo.HTTPClient != nil {
+		cfg.HTTPClient = dsInfo.HTTPClient
 	}
-
-	client := athena.New(sess, cfg)
-	return client, nil
+	return withEndpoint(cfg, dsInfo.StsEndpoint)
 }
 
-func (t *AwsAthenaDatasource) getEC2Client(datasourceInfo *backend.DataSourceInstanceSettings, region string) (*ec2.EC2, error) {
-	dsInfo, err := t.getDsInfo(datasourceInfo, region)
-	if err != nil {
-		return nil, err
+// withEndpoint returns the copy of the config which has the custom service endpoint.
+func withEndpoint(cfg *aws.Config, endpoint string) *aws.Config {
+	if endpoint == "" {
+		return cfg
 	}
-	cfg, err := t.getAwsConfig(dsInfo)
-	if err != nil {
-		return nil, err
-	}
-
-	sess, err := session.NewSession(cfg)
-	if err != nil {
-		return nil, err
-	}
-
-	client := ec2.New(sess, cfg)
-	return client, nil
+	return cfg.Copy().WithEndpoint(endpoint)
 }
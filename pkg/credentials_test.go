@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestRoleSessionName(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		assert.Equal(t, "GrafanaSession", roleSessionName(&DatasourceInfo{}))
+	})
+
+	t.Run("template", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{
+			AssumeRoleSessionName: "grafana-{{orgId}}-{{ datasourceId }}-{{datasourceName}}",
+			OrgID:                 2,
+			DatasourceID:          10,
+			DatasourceName:        "Athena (prod)",
+		}
+		assert.Equal(t, "grafana-2-10-Athena--prod-", roleSessionName(dsInfo))
+	})
+}
+
+type fakeProvider struct {
+	value    credentials.Value
+	err      error
+	expired  bool
+	retrieve int
+}
+
+func (p *fakeProvider) Retrieve() (credentials.Value, error) {
+	p.retrieve++
+	if p.err != nil {
+		return credentials.Value{}, p.err
+	}
+	p.expired = false
+	return p.value, nil
+}
+
+func (p *fakeProvider) IsExpired() bool {
+	return p.expired
+}
+
+func TestCredentialsCache(t *testing.T) {
+	t.Run("cache key", func(t *testing.T) {
+		c := newCredentialsCache(func(dsInfo *DatasourceInfo) ([]credentials.Provider, error) {
+			return []credentials.Provider{&fakeProvider{}}, nil
+		}, newCredentialsMetrics())
+		base := DatasourceInfo{AuthType: "keys", Region: "us-east-1", AccessKey: "AKID", SecretKey: "secret"}
+		creds, err := c.get(&base)
+		assert.Equal(t, nil, err)
+
+		same := base
+		sameCreds, _ := c.get(&same)
+		assert.Equal(t, creds, sameCreds)
+
+		for _, modify := range []func(dsInfo *DatasourceInfo){
+			func(dsInfo *DatasourceInfo) { dsInfo.SecretKey = "other" },
+			func(dsInfo *DatasourceInfo) { dsInfo.Region = "us-west-2" },
+			func(dsInfo *DatasourceInfo) { dsInfo.AuthType = "arn" },
+			func(dsInfo *DatasourceInfo) { dsInfo.ExternalId = "external" },
+		} {
+			other := base
+			modify(&other)
+			otherCreds, _ := c.get(&other)
+			assert.Assert(t, creds != otherCreds)
+		}
+	})
+
+	t.Run("refresh", func(t *testing.T) {
+		p := &fakeProvider{value: credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret", ProviderName: "FakeProvider"}}
+		metrics := newCredentialsMetrics()
+		c := newCredentialsCache(func(dsInfo *DatasourceInfo) ([]credentials.Provider, error) {
+			return []credentials.Provider{p}, nil
+		}, metrics)
+		creds, _ := c.get(&DatasourceInfo{AuthType: "keys"})
+
+		v, err := creds.Get()
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "FakeProvider", v.ProviderName)
+		_, _ = creds.Get()
+		assert.Equal(t, 1, p.retrieve)
+
+		p.expired = true
+		_, _ = creds.Get()
+		assert.Equal(t, 2, p.retrieve)
+		assert.Equal(t, float64(2), testutil.ToFloat64(metrics.refreshTotal.With(prometheus.Labels{"auth_type": "keys", "provider": "FakeProvider"})))
+
+		p.expired = true
+		p.err = errors.New("failed")
+		_, err = creds.Get()
+		assert.Assert(t, err != nil)
+		assert.Equal(t, float64(1), testutil.ToFloat64(metrics.refreshFailuresTotal.With(prometheus.Labels{"auth_type": "keys"})))
+	})
+}
+
+type fakeExpiringProvider struct {
+	credentials.Expiry
+	retrieve int
+}
+
+func (p *fakeExpiringProvider) Retrieve() (credentials.Value, error) {
+	p.retrieve++
+	// expires in 10 minutes, and is handled as expired 5 minutes before that
+	p.SetExpiration(time.Now().Add(10*time.Minute), 5*time.Minute)
+	return credentials.Value{AccessKeyID: "AKID", SecretAccessKey: "secret", ProviderName: "FakeExpiringProvider"}, nil
+}
+
+func TestCredentialsRefresh(t *testing.T) {
+	p := &fakeExpiringProvider{}
+	c := newCredentialsCache(func(dsInfo *DatasourceInfo) ([]credentials.Provider, error) {
+		return []credentials.Provider{p}, nil
+	}, newCredentialsMetrics())
+	creds, _ := c.get(&DatasourceInfo{AuthType: "arn"})
+
+	// credentials which are not retrieved yet are left to the first request
+	c.refreshExpiring(time.Now().Add(time.Hour))
+	assert.Equal(t, 0, p.retrieve)
+
+	_, err := creds.Get()
+	assert.NilError(t, err)
+	assert.Equal(t, 1, p.retrieve)
+	expiresAt, err := creds.ExpiresAt()
+	assert.NilError(t, err)
+	assert.Assert(t, expiresAt.Before(time.Now().Add(6*time.Minute)))
+
+	c.refreshExpiring(time.Now().Add(CREDENTIALS_REFRESH_INTERVAL))
+	assert.Equal(t, 1, p.retrieve)
+
+	// refreshed in the expiry window, before the credentials are expired
+	c.refreshExpiring(time.Now().Add(6 * time.Minute))
+	assert.Equal(t, 2, p.retrieve)
+	assert.Assert(t, !creds.IsExpired())
+	_, _ = creds.Get()
+	assert.Equal(t, 2, p.retrieve)
+
+	c.evict([]string{credentialsCacheKey(&DatasourceInfo{AuthType: "arn"})})
+	other, _ := c.get(&DatasourceInfo{AuthType: "arn"})
+	assert.Assert(t, creds != other)
+}
+
+func TestWithAssumeRole(t *testing.T) {
+	t.Run("not allowed", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{AuthType: "keys", AllowedAssumeRoleArns: []string{"arn:aws:iam::123456789012:role/a"}}
+		_, err := dsInfo.withAssumeRole("arn:aws:iam::123456789012:role/b")
+		assert.Assert(t, err != nil)
+	})
+
+	t.Run("through datasource role", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{
+			AuthType:              "arn",
+			AssumeRoleArn:         "arn:aws:iam::123456789012:role/grafana",
+			AllowedAssumeRoleArns: []string{"arn:aws:iam::210987654321:role/athena"},
+		}
+		roleInfo, err := dsInfo.withAssumeRole("arn:aws:iam::210987654321:role/athena")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "arn", roleInfo.AuthType)
+		assert.Equal(t, "arn:aws:iam::123456789012:role/grafana", roleInfo.IntermediateRoleArn)
+		assert.Equal(t, "arn:aws:iam::210987654321:role/athena", roleInfo.AssumeRoleArn)
+	})
+}
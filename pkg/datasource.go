@@ -10,34 +10,37 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/athena"
-	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/patrickmn/go-cache"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
 )
 
 type AwsAthenaDatasource struct {
-	cache   *cache.Cache
-	metrics *AwsAthenaMetrics
-}
-
-type AwsAthenaMetrics struct {
-	queriesTotal          *prometheus.CounterVec
-	dataScannedBytesTotal *prometheus.CounterVec
+	cache        *queryCache
+	metrics      *AwsAthenaMetrics
+	prewarm      *prewarmScheduler
+	budget       *scanBudget
+	audit        *auditLogger
+	streams      *cache.Cache
+	asyncQueries *cache.Cache
+	im           instancemgmt.InstanceManager
 }
 
 var (
 	legendFormatPattern *regexp.Regexp
-	clientCache         = make(map[string]*athena.Athena)
 )
 
 const (
@@ -50,41 +53,45 @@ func init() {
 	legendFormatPattern = regexp.MustCompile(`\{\{\s*(.+?)\s*\}\}`)
 }
 
-const metricNamespace = "aws_athena_datasource"
-
 func NewDataSource(mux *http.ServeMux) *AwsAthenaDatasource {
 	ds := &AwsAthenaDatasource{
-		cache: cache.New(300*time.Second, 5*time.Second),
-	}
-
-	metrics := &AwsAthenaMetrics{
-		queriesTotal: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name:      "data_query_total",
-				Help:      "data query counter",
-				Namespace: metricNamespace,
-			},
-			[]string{"region"},
-		),
-		dataScannedBytesTotal: prometheus.NewCounterVec(
-			prometheus.CounterOpts{
-				Name:      "data_scanned_bytes_total",
-				Help:      "scanned data size counter",
-				Namespace: metricNamespace,
-			},
-			[]string{"region"},
-		),
-	}
-	prometheus.MustRegister(metrics.queriesTotal)
-	prometheus.MustRegister(metrics.dataScannedBytesTotal)
+		cache:        newQueryCache(300*time.Second, 5*time.Second),
+		budget:       newScanBudget(),
+		audit:        defaultAuditLogger,
+		streams:      cache.New(STREAM_QUERY_TTL, 1*time.Minute),
+		asyncQueries: cache.New(ASYNC_QUERY_TTL, 1*time.Minute),
+		im:           datasource.NewInstanceManager(newDataSourceInstance),
+	}
+
+	metrics := newAwsAthenaMetrics()
+	metrics.register()
+	prometheus.MustRegister(defaultCredentialsCache.metrics.refreshTotal)
+	prometheus.MustRegister(defaultCredentialsCache.metrics.refreshFailuresTotal)
+	go defaultCredentialsCache.refreshLoop(CREDENTIALS_REFRESH_INTERVAL)
+	go ds.budget.sweepLoop(BUDGET_SWEEP_INTERVAL)
 	ds.metrics = metrics
 
+	ds.prewarm = newPrewarmScheduler(ds)
+	go ds.prewarm.run()
+
 	mux.HandleFunc("/regions", ds.handleResourceRegions)
 	mux.HandleFunc("/workgroup_names", ds.handleResourceWorkgroupNames)
 	mux.HandleFunc("/named_query_names", ds.handleResourceNamedQueryNames)
 	mux.HandleFunc("/named_query_queries", ds.handleResourceNamedQueryQueries)
 	mux.HandleFunc("/query_executions", ds.handleResourceQueryExecutions)
 	mux.HandleFunc("/query_executions_by_name", ds.handleResourceQueryExecutionsByName)
+	mux.HandleFunc("/cache_entries", ds.handleResourceCacheEntries)
+	mux.HandleFunc("/invalidate_cache", ds.handleResourceInvalidateCache)
+	mux.HandleFunc("/warm_cache", ds.handleResourceWarmCache)
+	mux.HandleFunc("/scan_budget", ds.handleResourceScanBudget)
+	mux.HandleFunc("/explain", ds.handleResourceExplain)
+	mux.HandleFunc("/variable_query", ds.handleResourceVariableQuery)
+	mux.HandleFunc("/partition_values", ds.handleResourcePartitionValues)
+	mux.HandleFunc("/stream_query", ds.handleResourceStreamQuery)
+	mux.HandleFunc("/async_query_start", ds.handleResourceAsyncQueryStart)
+	mux.HandleFunc("/async_query_poll", ds.handleResourceAsyncQueryPoll)
+	mux.HandleFunc("/async_query_results", ds.handleResourceAsyncQueryResults)
+	mux.HandleFunc("/async_query_cancel", ds.handleResourceAsyncQueryCancel)
 
 	return ds
 }
@@ -97,15 +104,23 @@ func (ds *AwsAthenaDatasource) CheckHealth(ctx context.Context, req *backend.Che
 		res.Message = "Plugin is Running"
 		return res, nil
 	}
+	ds.prewarm.register(req.PluginContext)
 
-	svc, err := ds.getClient(req.PluginContext.DataSourceInstanceSettings, "us-east-1")
+	clients, err := ds.getClients(req.PluginContext, "us-east-1")
 	if err != nil {
 		res.Status = backend.HealthStatusError
 		res.Message = "Unable to create client"
 		return res, nil
 	}
 
-	_, err = svc.ListNamedQueriesWithContext(ctx, &athena.ListNamedQueriesInput{})
+	creds, err := clients.credentials.Get()
+	if err != nil {
+		res.Status = backend.HealthStatusError
+		res.Message = "Unable to get credentials: " + err.Error()
+		return res, nil
+	}
+
+	_, err = clients.athena.ListNamedQueriesWithContext(ctx, &athena.ListNamedQueriesInput{})
 	if err != nil {
 		res.Status = backend.HealthStatusError
 		res.Message = "Unable to call Athena API"
@@ -113,16 +128,26 @@ func (ds *AwsAthenaDatasource) CheckHealth(ctx context.Context, req *backend.Che
 	}
 
 	res.Status = backend.HealthStatusOk
-	res.Message = "Success"
+	res.Message = "Success (credentials provided by " + creds.ProviderName + ")"
 	return res, nil
 }
 
 func (ds *AwsAthenaDatasource) QueryData(ctx context.Context, tsdbReq *backend.QueryDataRequest) (*backend.QueryDataResponse, error) {
+	ctx = contextWithTraceHeaders(ctx, tsdbReq.Headers)
+	ctx, span := startSpan(ctx, "QueryData",
+		attribute.Int64("datasourceId", tsdbReq.PluginContext.DataSourceInstanceSettings.ID),
+		attribute.Int("queries", len(tsdbReq.Queries)),
+	)
+	defer span.End()
+
 	responses := &backend.QueryDataResponse{
 		Responses: map[string]backend.DataResponse{},
 	}
+	ds.prewarm.register(tsdbReq.PluginContext)
 
-	targets := make([]AwsAthenaQuery, 0)
+	// setup errors are reported to the query, errors of some regions are reported as notices
+	targetGroups := make([][]AwsAthenaQuery, 0)
+	setupResults := make([][]regionResult, 0)
 	for _, query := range tsdbReq.Queries {
 		target := AwsAthenaQuery{}
 		if err := json.Unmarshal([]byte(query.JSON), &target); err != nil {
@@ -130,54 +155,147 @@ func (ds *AwsAthenaDatasource) QueryData(ctx context.Context, tsdbReq *backend.Q
 		}
 		target.From = query.TimeRange.From
 		target.To = query.TimeRange.To
-
-		svc, err := ds.getClient(tsdbReq.PluginContext.DataSourceInstanceSettings, target.Region)
-		if err != nil {
-			return nil, err
+		target.interval = query.Interval
+		if err := target.expandQueryString(); err != nil {
+			responses.Responses[target.RefId] = backend.DataResponse{Error: err}
+			continue
 		}
-		dsInfo, err := ds.getDsInfo(tsdbReq.PluginContext.DataSourceInstanceSettings, target.Region)
+
+		regions, err := ds.expandRegions(tsdbReq.PluginContext, target.Region)
 		if err != nil {
-			return nil, err
+			responses.Responses[target.RefId] = backend.DataResponse{Error: err}
+			continue
 		}
-		if target.Region == "default" || target.Region == "" {
-			target.Region = dsInfo.DefaultRegion
+		targets := make([]AwsAthenaQuery, 0, len(regions))
+		results := make([]regionResult, len(regions))
+		for i, region := range regions {
+			regionTarget, err := ds.newRegionTarget(tsdbReq.PluginContext, target, region)
+			targets = append(targets, regionTarget)
+			results[i].err = err
 		}
-		target.client = svc
-		target.cache = ds.cache
-		target.metrics = ds.metrics
-		target.datasourceID = tsdbReq.PluginContext.DataSourceInstanceSettings.ID
-
-		targets = append(targets, target)
+		targetGroups = append(targetGroups, targets)
+		setupResults = append(setupResults, results)
 	}
 
-	for _, target := range targets {
-		result, err := target.getQueryResults(ctx, tsdbReq.PluginContext)
-		if err != nil {
-			responses.Responses[target.RefId] = backend.DataResponse{
-				Error: err,
+	for g, targets := range targetGroups {
+		results := setupResults[g]
+		if len(targets) == 1 {
+			target := targets[0]
+			if results[0].err != nil {
+				responses.Responses[target.RefId] = backend.DataResponse{
+					Error: results[0].err,
+				}
+			} else if frames, err := target.getFrames(ctx, tsdbReq.PluginContext); err != nil {
+				responses.Responses[target.RefId] = backend.DataResponse{
+					Error: err,
+				}
+			} else {
+				responses.Responses[target.RefId] = backend.DataResponse{
+					Frames: append(responses.Responses[target.RefId].Frames, frames...),
+				}
 			}
 			continue
 		}
 
-		timeFormat := target.TimeFormat
-		if timeFormat == "" {
-			timeFormat = time.RFC3339Nano
-		}
-
-		if frames, err := parseResponse(result, target.RefId, target.From, target.To, target.TimestampColumn, target.ValueColumn, target.LegendFormat, timeFormat); err != nil {
-			responses.Responses[target.RefId] = backend.DataResponse{
-				Error: err,
-			}
-		} else {
-			responses.Responses[target.RefId] = backend.DataResponse{
-				Frames: append(responses.Responses[target.RefId].Frames, frames...),
+		// multi-region query, run in each region at once
+		var wg sync.WaitGroup
+		for i := range targets {
+			if results[i].err != nil {
+				continue
 			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i].frames, results[i].err = targets[i].getFrames(ctx, tsdbReq.PluginContext)
+			}(i)
 		}
+		wg.Wait()
+		refId := targets[0].RefId
+		responses.Responses[refId] = mergeRegionResults(refId, targets, results)
 	}
 
 	return responses, nil
 }
 
+// newRegionTarget returns the copy of the query target which runs in the region.
+func (ds *AwsAthenaDatasource) newRegionTarget(pluginContext backend.PluginContext, target AwsAthenaQuery, region string) (AwsAthenaQuery, error) {
+	regionTarget := target
+	regionTarget.Region = region
+	regionTarget.Inputs = append([]athena.GetQueryResultsInput{}, target.Inputs...)
+
+	// credentials are retrieved on the first API call of the query, and the error is reported to the query
+	svc, err := ds.getQueryClient(pluginContext, regionTarget.Region, regionTarget.AssumeRoleArn)
+	if err != nil {
+		return regionTarget, err
+	}
+	dsInfo, err := ds.getDsInfo(pluginContext, regionTarget.Region)
+	if err != nil {
+		return regionTarget, err
+	}
+	if regionTarget.Region == "default" || regionTarget.Region == "" {
+		regionTarget.Region = dsInfo.DefaultRegion
+	}
+	regionTarget.client = svc
+	regionTarget.cache = ds.cache
+	regionTarget.metrics = ds.metrics
+	regionTarget.dsInfo = dsInfo
+	regionTarget.budget = ds.budget
+	regionTarget.audit = ds.audit
+	regionTarget.orgID = pluginContext.OrgID
+	role := ""
+	if pluginContext.User != nil {
+		regionTarget.user = pluginContext.User.Login
+		role = pluginContext.User.Role
+	}
+	if regionTarget.QueryString != "" {
+		regionTarget.WorkGroup = dsInfo.routeWorkgroup(regionTarget.WorkGroup, pluginContext.OrgID, regionTarget.user, role)
+	}
+	regionTarget.datasourceID = pluginContext.DataSourceInstanceSettings.ID
+	return regionTarget, nil
+}
+
+func (target *AwsAthenaQuery) getFrames(ctx context.Context, pluginContext backend.PluginContext) ([]*data.Frame, error) {
+	result, err := target.getQueryResults(ctx, pluginContext)
+	if err != nil {
+		return nil, err
+	}
+
+	timeFormat := target.TimeFormat
+	if timeFormat == "" {
+		timeFormat = time.RFC3339Nano
+	}
+
+	_, span := startSpan(ctx, "parseResponse", attribute.String("refId", target.RefId), attribute.Int("rows", len(result.ResultSet.Rows)))
+	var frames []*data.Frame
+	switch target.Format {
+	case FORMAT_LOGS:
+		frames, err = parseLogsResponse(result, target.RefId, target.TimestampColumn, target.MessageColumn, target.LevelColumn, timeFormat)
+	case FORMAT_ANNOTATIONS:
+		frames, err = parseAnnotationsResponse(result, target.RefId, annotationColumns{
+			Time:    target.TimestampColumn,
+			TimeEnd: target.TimeEndColumn,
+			Title:   target.TitleColumn,
+			Text:    target.TextColumn,
+			Tags:    target.TagsColumn,
+		}, timeFormat)
+	default:
+		frames, err = parseResponse(result, target.RefId, target.From, target.To, target.TimestampColumn, target.ValueColumn, target.LegendFormat, timeFormat)
+	}
+	if err == nil {
+		span.SetAttributes(attribute.Int("frames", len(frames)))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, err
+	}
+	for _, frame := range frames {
+		for _, warning := range target.warnings {
+			frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityWarning, Text: warning})
+		}
+	}
+	return frames, nil
+}
+
 func parseResponse(resp *athena.GetQueryResultsOutput, refId string, from time.Time, to time.Time, timestampColumn string, valueColumn string, legendFormat string, timeFormat string) ([]*data.Frame, error) {
 	warnings := []string{}
 
@@ -441,14 +559,14 @@ func (ds *AwsAthenaDatasource) handleResourceRegions(rw http.ResponseWriter, req
 	ctx := req.Context()
 	pluginContext := httpadapter.PluginConfigFromContext(ctx)
 
-	svc, err := ds.getEC2Client(pluginContext.DataSourceInstanceSettings, "us-east-1")
-	if err != nil {
-		writeResult(rw, "?", nil, err)
-		return
-	}
+	regions := ds.listRegions(ctx, pluginContext)
+	writeResult(rw, "regions", regions, nil)
+}
 
+// listRegions returns the regions for the region selection, the well-known regions are returned when the regions can't be described.
+func (ds *AwsAthenaDatasource) listRegions(ctx context.Context, pluginContext backend.PluginContext) []string {
 	regions := []string{"default"}
-	ro, err := svc.DescribeRegions(&ec2.DescribeRegionsInput{})
+	describedRegions, err := ds.getRegions(ctx, pluginContext)
 	if err != nil {
 		// ignore error
 		regions = append(regions, []string{
@@ -479,13 +597,11 @@ func (ds *AwsAthenaDatasource) handleResourceRegions(rw http.ResponseWriter, req
 			"us-west-2",
 		}...)
 	} else {
-		for _, r := range ro.Regions {
-			regions = append(regions, *r.RegionName)
-		}
+		regions = append(regions, describedRegions...)
 	}
 	sort.Strings(regions)
 
-	writeResult(rw, "regions", regions, err)
+	return regions
 }
 
 func (ds *AwsAthenaDatasource) handleResourceWorkgroupNames(rw http.ResponseWriter, req *http.Request) {
@@ -499,12 +615,21 @@ func (ds *AwsAthenaDatasource) handleResourceWorkgroupNames(rw http.ResponseWrit
 	urlQuery := req.URL.Query()
 	region := urlQuery.Get("region")
 
-	svc, err := ds.getClient(pluginContext.DataSourceInstanceSettings, region)
+	workgroupNames, err := ds.getWorkgroupNames(ctx, pluginContext, region)
 	if err != nil {
 		writeResult(rw, "?", nil, err)
 		return
 	}
 
+	writeResult(rw, "workgroup_names", workgroupNames, err)
+}
+
+func (ds *AwsAthenaDatasource) getWorkgroupNames(ctx context.Context, pluginContext backend.PluginContext, region string) ([]string, error) {
+	svc, err := ds.getClient(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+
 	workgroupNames := make([]string, 0)
 	li := &athena.ListWorkGroupsInput{}
 	lo := &athena.ListWorkGroupsOutput{}
@@ -514,14 +639,13 @@ func (ds *AwsAthenaDatasource) handleResourceWorkgroupNames(rw http.ResponseWrit
 			return !lastPage
 		})
 	if err != nil {
-		writeResult(rw, "?", nil, err)
-		return
+		return nil, err
 	}
 	for _, w := range lo.WorkGroups {
 		workgroupNames = append(workgroupNames, *w.Name)
 	}
 
-	writeResult(rw, "workgroup_names", workgroupNames, err)
+	return workgroupNames, nil
 }
 
 func (ds *AwsAthenaDatasource) handleResourceNamedQueryNames(rw http.ResponseWriter, req *http.Request) {
@@ -536,11 +660,19 @@ func (ds *AwsAthenaDatasource) handleResourceNamedQueryNames(rw http.ResponseWri
 	region := urlQuery.Get("region")
 	workGroup := urlQuery.Get("workGroup")
 
-	svc, err := ds.getClient(pluginContext.DataSourceInstanceSettings, region)
+	data, err := ds.getNamedQueryNames(ctx, pluginContext, region, workGroup)
 	if err != nil {
 		writeResult(rw, "?", nil, err)
 		return
 	}
+	writeResult(rw, "named_query_names", data, err)
+}
+
+func (ds *AwsAthenaDatasource) getNamedQueryNames(ctx context.Context, pluginContext backend.PluginContext, region string, workGroup string) ([]string, error) {
+	svc, err := ds.getClient(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
 
 	data := make([]string, 0)
 	var workGroupParam *string
@@ -557,26 +689,24 @@ func (ds *AwsAthenaDatasource) handleResourceNamedQueryNames(rw http.ResponseWri
 			lo.NamedQueryIds = append(lo.NamedQueryIds, page.NamedQueryIds...)
 			return !lastPage
 		}); err != nil {
-		writeResult(rw, "?", nil, err)
-		return
+		return nil, err
 	}
 	for i := 0; i < len(lo.NamedQueryIds); i += AWS_API_RESULT_MAX_LENGTH {
 		e := int64(math.Min(float64(i+AWS_API_RESULT_MAX_LENGTH), float64(len(lo.NamedQueryIds))))
 		bi := &athena.BatchGetNamedQueryInput{NamedQueryIds: lo.NamedQueryIds[i:e]}
 		bo, err := svc.BatchGetNamedQueryWithContext(ctx, bi)
 		if err != nil {
-			writeResult(rw, "?", nil, err)
-			return
+			return nil, err
 		}
 		for _, q := range bo.NamedQueries {
 			data = append(data, *q.Name)
 		}
 	}
-	writeResult(rw, "named_query_names", data, err)
+	return data, nil
 }
 
 func (ds *AwsAthenaDatasource) getNamedQueryQueries(ctx context.Context, pluginContext backend.PluginContext, region string, workGroup string, pattern string) ([]string, error) {
-	svc, err := ds.getClient(pluginContext.DataSourceInstanceSettings, region)
+	svc, err := ds.getClient(pluginContext, region)
 	if err != nil {
 		return nil, err
 	}
@@ -640,7 +770,7 @@ func (ds *AwsAthenaDatasource) handleResourceNamedQueryQueries(rw http.ResponseW
 }
 
 func (ds *AwsAthenaDatasource) getQueryExecutions(ctx context.Context, pluginContext backend.PluginContext, region string, workGroup string, pattern string, to time.Time) ([]*athena.QueryExecution, error) {
-	svc, err := ds.getClient(pluginContext.DataSourceInstanceSettings, region)
+	svc, err := ds.getClient(pluginContext, region)
 	if err != nil {
 		return nil, err
 	}
@@ -746,12 +876,7 @@ func (ds *AwsAthenaDatasource) handleResourceQueryExecutions(rw http.ResponseWri
 		return
 	}
 
-	if limit != -1 {
-		limit = int64(math.Min(float64(limit), float64(len(queryExecutions))))
-		queryExecutions = queryExecutions[0:limit]
-	}
-
-	writeResult(rw, "query_executions", queryExecutions, err)
+	writeResult(rw, "query_executions", limitQueryExecutions(queryExecutions, limit), err)
 }
 
 func (ds *AwsAthenaDatasource) handleResourceQueryExecutionsByName(rw http.ResponseWriter, req *http.Request) {
@@ -778,32 +903,37 @@ func (ds *AwsAthenaDatasource) handleResourceQueryExecutionsByName(rw http.Respo
 		return
 	}
 
-	namedQueryQueries, err := ds.getNamedQueryQueries(ctx, pluginContext, region, workGroup, pattern)
+	queryExecutions, err := ds.getQueryExecutionsByName(ctx, pluginContext, region, workGroup, pattern, to)
 	if err != nil {
 		writeResult(rw, "?", nil, err)
 		return
 	}
+
+	writeResult(rw, "query_executions_by_name", limitQueryExecutions(queryExecutions, limit), err)
+}
+
+func (ds *AwsAthenaDatasource) getQueryExecutionsByName(ctx context.Context, pluginContext backend.PluginContext, region string, workGroup string, pattern string, to time.Time) ([]*athena.QueryExecution, error) {
+	namedQueryQueries, err := ds.getNamedQueryQueries(ctx, pluginContext, region, workGroup, pattern)
+	if err != nil {
+		return nil, err
+	}
 	//if we did not find the named query based on the string, we return nil
 	if len(namedQueryQueries) == 0 {
-		writeResult(rw, "?", nil, errors.New("No query with that name found"))
-		return
+		return nil, errors.New("No query with that name found")
 	}
 	sql := namedQueryQueries[0]
 	sql = strings.TrimRight(sql, " ")
 	sql = strings.TrimRight(sql, ";")
 
-	queryExecutions, err := ds.getQueryExecutions(ctx, pluginContext, region, workGroup, "^"+sql+"$", to)
-	if err != nil {
-		writeResult(rw, "?", nil, err)
-		return
-	}
+	return ds.getQueryExecutions(ctx, pluginContext, region, workGroup, "^"+sql+"$", to)
+}
 
+func limitQueryExecutions(queryExecutions []*athena.QueryExecution, limit int64) []*athena.QueryExecution {
 	if limit != -1 {
 		limit = int64(math.Min(float64(limit), float64(len(queryExecutions))))
 		queryExecutions = queryExecutions[0:limit]
 	}
-
-	writeResult(rw, "query_executions_by_name", queryExecutions, err)
+	return queryExecutions
 }
 
 type Duration time.Duration
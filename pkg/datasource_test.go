@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"testing"
 	"time"
 
@@ -14,9 +18,90 @@ import (
 
 func TestAwsAthenaDatasource(t *testing.T) {
 	t.Run("QueryData", func(t *testing.T) {
+		t.Run("credentials error is reported to the query", func(t *testing.T) {
+			fake, server := newFakeAthenaServer(t)
+			defer server.Close()
+			sts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(rw, `<ErrorResponse><Error><Type>Sender</Type><Code>AccessDenied</Code><Message>not authorized</Message></Error></ErrorResponse>`)
+			}))
+			defer sts.Close()
+
+			role := "arn:aws:iam::123456789012:role/denied"
+			ds := newTestDataSource()
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						ID:       101,
+						JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `","stsEndpoint":"` + sts.URL + `","allowedAssumeRoleArns":["` + role + `"]}`),
+						DecryptedSecureJSONData: map[string]string{
+							"accessKey": "AKID",
+							"secretKey": "secret",
+						},
+					},
+				},
+				Queries: []backend.DataQuery{
+					{RefID: "A", JSON: []byte(`{"refId":"A","region":"default","workgroup":"primary","queryString":"SELECT 1","format":"table"}`)},
+					{RefID: "B", JSON: []byte(`{"refId":"B","region":"default","workgroup":"primary","queryString":"SELECT 2","format":"table","assumeRoleArn":"` + role + `"}`)},
+				},
+			})
+			assert.NilError(t, err)
+			assert.NilError(t, resp.Responses["A"].Error)
+			assert.Equal(t, 1, len(resp.Responses["A"].Frames))
+			assert.ErrorContains(t, resp.Responses["B"].Error, "NoCredentialProviders")
+			assert.Equal(t, 1, fake.count("StartQueryExecution"))
+		})
+
+		t.Run("output location falls back to the datasource setting", func(t *testing.T) {
+			fake, server := newFakeAthenaServer(t)
+			defer server.Close()
+			ds := newTestDataSource()
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						ID:       105,
+						JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `","outputLocation":"s3://results/"}`),
+						DecryptedSecureJSONData: map[string]string{
+							"accessKey": "AKID",
+							"secretKey": "secret",
+						},
+					},
+				},
+				Queries: []backend.DataQuery{
+					{RefID: "A", JSON: []byte(`{"refId":"A","region":"default","workgroup":"primary","queryString":"SELECT 1","format":"table"}`)},
+				},
+			})
+			assert.NilError(t, err)
+			assert.NilError(t, resp.Responses["A"].Error)
+			var si athena.StartQueryExecutionInput
+			assert.NilError(t, json.Unmarshal(fake.body("StartQueryExecution"), &si))
+			assert.Equal(t, "s3://results/", aws.StringValue(si.ResultConfiguration.OutputLocation))
+		})
+
+		t.Run("empty region list is reported to the query", func(t *testing.T) {
+			ds := newTestDataSource()
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: backend.PluginContext{
+					DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+						ID:       102,
+						JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1"}`),
+					},
+				},
+				Queries: []backend.DataQuery{
+					{RefID: "A", JSON: []byte(`{"refId":"A","region":", ","workgroup":"primary","queryString":"SELECT 1","format":"table"}`)},
+				},
+			})
+			assert.NilError(t, err)
+			assert.Error(t, resp.Responses["A"].Error, `no region is specified: ", "`)
+		})
+
 		t.Run("simple query", func(t *testing.T) {
+			// the query execution is in the AWS account of the maintainer
+			if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+				t.Skip("AWS credentials are not set")
+			}
 			ctx := context.Background()
-			q, _ := json.Marshal(Target{
+			q, _ := json.Marshal(AwsAthenaQuery{
 				RefId:  "A",
 				Format: "timeserie",
 				Region: "us-east-1",
@@ -28,7 +113,7 @@ func TestAwsAthenaDatasource(t *testing.T) {
 				TimestampColumn: "ts",
 				ValueColumn:     "_col2",
 				LegendFormat:    "",
-				timeFormat:      "",
+				TimeFormat:      "",
 				From:            time.Now().Add(time.Duration(-24) * time.Hour),
 				To:              time.Now(),
 			})
@@ -44,7 +129,7 @@ func TestAwsAthenaDatasource(t *testing.T) {
 					},
 				},
 			}
-			ds := &AwsAthenaDatasource{}
+			ds := NewDataSource(http.NewServeMux())
 			result, err := ds.QueryData(ctx, query)
 			assert.Equal(t, nil, err)
 			r := result.Responses["A"].Frames[0].Fields[0].CopyAt(0)
@@ -104,8 +189,8 @@ func TestAwsAthenaDatasource(t *testing.T) {
 			assert.Equal(t, "A", frames[0].RefID)
 			assert.Equal(t, "timestamp", frames[0].Fields[0].Name)
 			assert.Equal(t, "value", frames[0].Fields[1].Name)
-			assert.Equal(t, float64(100), frames[0].Fields[1].At(0))
-			assert.Equal(t, float64(200), frames[0].Fields[1].At(1))
+			assert.Equal(t, float64(100), *frames[0].Fields[1].At(0).(*float64))
+			assert.Equal(t, float64(200), *frames[0].Fields[1].At(1).(*float64))
 			et1, _ := time.Parse("2006-01-02 15:04:05.000", "2006-01-02 01:04:05.000")
 			t1, ok := frames[0].Fields[0].At(0).(*time.Time)
 			assert.Equal(t, true, ok)
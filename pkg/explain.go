@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/net/context"
+)
+
+const (
+	DEFAULT_SCAN_COST_PER_TERABYTE = 5.0
+	// Athena charges at least 10MB per query
+	MIN_BILLED_SCANNED_BYTES = 10 * 1024 * 1024
+	// EXPLAIN ANALYZE runs the query, it waits longer than the query API, 1 second per poll
+	EXPLAIN_ANALYZE_WAIT_COUNT = 300
+)
+
+type explainRequest struct {
+	From    time.Time       `json:"from"`
+	To      time.Time       `json:"to"`
+	Range   Duration        `json:"range"`
+	Analyze bool            `json:"analyze"`
+	Query   json.RawMessage `json:"query"`
+}
+
+type explainTable struct {
+	Database   string   `json:"database"`
+	Table      string   `json:"table"`
+	Partitions []string `json:"partitions"`
+	SizeBytes  *int64   `json:"sizeBytes,omitempty"`
+}
+
+type explainResult struct {
+	QueryString           string         `json:"queryString"`
+	Plan                  []byte         `json:"plan"`
+	Tables                []explainTable `json:"tables"`
+	EstimatedScannedBytes *int64         `json:"estimatedScannedBytes,omitempty"`
+	EstimatedCost         *float64       `json:"estimatedCost,omitempty"`
+	EstimateSource        string         `json:"estimateSource,omitempty"`
+	Warnings              []string       `json:"warnings"`
+}
+
+// explainIO is the output of EXPLAIN (TYPE IO, FORMAT JSON).
+type explainIO struct {
+	InputTableColumnInfos []struct {
+		Table struct {
+			SchemaTable struct {
+				Schema string `json:"schema"`
+				Table  string `json:"table"`
+			} `json:"schemaTable"`
+		} `json:"table"`
+		ColumnConstraints []struct {
+			ColumnName string `json:"columnName"`
+			Domain     struct {
+				Ranges []struct {
+					Low  explainIOMarker `json:"low"`
+					High explainIOMarker `json:"high"`
+				} `json:"ranges"`
+			} `json:"domain"`
+		} `json:"columnConstraints"`
+		Estimate struct {
+			OutputSizeInBytes interface{} `json:"outputSizeInBytes"`
+		} `json:"estimate"`
+	} `json:"inputTableColumnInfos"`
+}
+
+type explainIOMarker struct {
+	Value *string `json:"value"`
+	Bound string  `json:"bound"`
+}
+
+func (ds *AwsAthenaDatasource) handleResourceExplain(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+
+	var er explainRequest
+	if err := json.NewDecoder(req.Body).Decode(&er); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	if er.To.IsZero() {
+		er.To = time.Now()
+	}
+	if er.From.IsZero() {
+		r := time.Duration(er.Range)
+		if r == 0 {
+			r = time.Hour
+		}
+		er.From = er.To.Add(-r)
+	}
+
+	result, err := ds.explain(ctx, pluginContext, er)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	writeResult(rw, "explain", result, nil)
+}
+
+// explain runs EXPLAIN of the query, and estimates the scanned bytes and the cost of the query.
+func (ds *AwsAthenaDatasource) explain(ctx context.Context, pluginContext backend.PluginContext, er explainRequest) (*explainResult, error) {
+	var target AwsAthenaQuery
+	if err := json.Unmarshal(er.Query, &target); err != nil {
+		return nil, err
+	}
+	if target.QueryString == "" {
+		return nil, fmt.Errorf("queryString should be set")
+	}
+	if target.Region == "*" || strings.Contains(target.Region, ",") {
+		return nil, fmt.Errorf("explain supports single region only")
+	}
+	target.From = er.From
+	target.To = er.To
+	from, to := truncateTimeRange(target.From, target.To, time.Duration(target.TimeAlignment))
+	queryString, err := expandMacros(target.QueryString, from, to, target.Variables)
+	if err != nil {
+		return nil, err
+	}
+	target, err = ds.newRegionTarget(pluginContext, target, target.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &explainResult{
+		QueryString: queryString,
+		Tables:      make([]explainTable, 0),
+		Warnings:    make([]string, 0),
+	}
+
+	statement := "EXPLAIN " + queryString
+	explainTarget := target
+	if er.Analyze {
+		statement = "EXPLAIN ANALYZE " + queryString
+		explainTarget.waitCount = EXPLAIN_ANALYZE_WAIT_COUNT
+	}
+	lines, execution, err := explainTarget.executeStatement(ctx, pluginContext, statement)
+	if err != nil {
+		return nil, err
+	}
+	frame := data.NewFrame("plan", data.NewField("Query Plan", nil, lines))
+	frame.RefID = target.RefId
+	if result.Plan, err = frame.MarshalArrow(); err != nil {
+		return nil, err
+	}
+	if er.Analyze && execution.Statistics != nil && execution.Statistics.DataScannedInBytes != nil {
+		result.EstimatedScannedBytes = execution.Statistics.DataScannedInBytes
+		result.EstimateSource = "explain_analyze"
+	}
+
+	// tables and partitions are taken from the IO plan, fallback to the tables in the query
+	var ioEstimate *int64
+	if lines, _, err := target.executeStatement(ctx, pluginContext, "EXPLAIN (TYPE IO, FORMAT JSON) "+queryString); err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("failed to get IO plan: %s", err.Error()))
+		tokens, _ := tokenizeSQL(queryString)
+		tables, _ := referencedTables(tokens, "default")
+		for _, table := range tables {
+			// the catalog of the fully qualified name isn't shown
+			parts := strings.Split(table, ".")
+			result.Tables = append(result.Tables, explainTable{Database: parts[len(parts)-2], Table: parts[len(parts)-1], Partitions: make([]string, 0)})
+		}
+	} else {
+		result.Tables, ioEstimate, err = parseExplainIO(strings.Join(lines, "\n"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if result.EstimatedScannedBytes == nil && ioEstimate != nil {
+		result.EstimatedScannedBytes = ioEstimate
+		result.EstimateSource = "explain_io"
+	}
+	if result.EstimatedScannedBytes == nil {
+		scannedBytesCacheKey := "ScannedBytes/" + strconv.FormatInt(target.datasourceID, 10) + "/" + target.cacheScope() + "/" + queryHash(queryString)
+		if item, _, found := ds.cache.GetWithExpiration(scannedBytesCacheKey); found {
+			if bytes, ok := item.(int64); ok {
+				result.EstimatedScannedBytes = aws.Int64(bytes)
+				result.EstimateSource = "previous_execution"
+			}
+		}
+	}
+	if result.EstimatedScannedBytes == nil {
+		ds.estimateFromGlue(ctx, pluginContext, target.Region, result)
+	}
+
+	if result.EstimatedScannedBytes != nil {
+		price := target.dsInfo.ScanCostPerTerabyte
+		if price == 0 {
+			price = DEFAULT_SCAN_COST_PER_TERABYTE
+		}
+		bytes := math.Max(float64(*result.EstimatedScannedBytes), MIN_BILLED_SCANNED_BYTES)
+		result.EstimatedCost = aws.Float64(bytes / (1 << 40) * price)
+	}
+
+	return result, nil
+}
+
+// estimateFromGlue sums up the table size in Glue table statistics, it is the upper bound of the scanned bytes.
+func (ds *AwsAthenaDatasource) estimateFromGlue(ctx context.Context, pluginContext backend.PluginContext, region string, result *explainResult) {
+	svc, err := ds.getGlueClient(pluginContext, region)
+	if err != nil {
+		result.Warnings = append(result.Warnings, err.Error())
+		return
+	}
+	var total int64
+	for i, table := range result.Tables {
+		to, err := svc.GetTableWithContext(ctx, &glue.GetTableInput{
+			DatabaseName: aws.String(table.Database),
+			Name:         aws.String(table.Table),
+		})
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("failed to get table statistics of %s.%s: %s", table.Database, table.Table, err.Error()))
+			return
+		}
+		size, ok := glueTableSize(to.Table)
+		if !ok {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("table statistics of %s.%s are not available", table.Database, table.Table))
+			return
+		}
+		result.Tables[i].SizeBytes = aws.Int64(size)
+		total += size
+	}
+	if len(result.Tables) > 0 {
+		result.EstimatedScannedBytes = aws.Int64(total)
+		result.EstimateSource = "glue_table_statistics"
+	}
+}
+
+func glueTableSize(table *glue.TableData) (int64, bool) {
+	if table == nil {
+		return 0, false
+	}
+	// totalSize is set by ANALYZE, sizeKey is set by Glue crawler
+	for _, key := range []string{"totalSize", "sizeKey"} {
+		if v, ok := table.Parameters[key]; ok && v != nil {
+			if size, err := strconv.ParseInt(*v, 10, 64); err == nil {
+				return size, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseExplainIO returns the input tables with partition constraints, and the estimated input size if available.
+func parseExplainIO(plan string) ([]explainTable, *int64, error) {
+	var io explainIO
+	if err := json.Unmarshal([]byte(plan), &io); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse IO plan: %s", err.Error())
+	}
+	tables := make([]explainTable, 0, len(io.InputTableColumnInfos))
+	var estimate *int64
+	for _, info := range io.InputTableColumnInfos {
+		table := explainTable{
+			Database:   info.Table.SchemaTable.Schema,
+			Table:      info.Table.SchemaTable.Table,
+			Partitions: make([]string, 0),
+		}
+		for _, c := range info.ColumnConstraints {
+			for _, r := range c.Domain.Ranges {
+				table.Partitions = append(table.Partitions, formatConstraintRange(c.ColumnName, r.Low, r.High))
+			}
+		}
+		tables = append(tables, table)
+
+		// Athena returns "NaN" when the statistics are not available
+		if size, ok := info.Estimate.OutputSizeInBytes.(float64); ok {
+			if estimate == nil {
+				estimate = aws.Int64(0)
+			}
+			*estimate += int64(size)
+		}
+	}
+	return tables, estimate, nil
+}
+
+func formatConstraintRange(column string, low explainIOMarker, high explainIOMarker) string {
+	if low.Value != nil && high.Value != nil && *low.Value == *high.Value && low.Bound == "EXACTLY" && high.Bound == "EXACTLY" {
+		return fmt.Sprintf("%s = %s", column, *low.Value)
+	}
+	conditions := make([]string, 0, 2)
+	if low.Value != nil {
+		op := ">="
+		if low.Bound == "ABOVE" {
+			op = ">"
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", column, op, *low.Value))
+	}
+	if high.Value != nil {
+		op := "<="
+		if high.Bound == "BELOW" {
+			op = "<"
+		}
+		conditions = append(conditions, fmt.Sprintf("%s %s %s", column, op, *high.Value))
+	}
+	if len(conditions) == 0 {
+		return column + " IS NOT NULL"
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// executeStatement runs the statement without the cache, and returns the first column of the result rows.
+// The statement is checked by the guardrails and the scan limit policy as the other posted queries.
+func (query *AwsAthenaQuery) executeStatement(ctx context.Context, pluginContext backend.PluginContext, statement string) ([]string, *athena.QueryExecution, error) {
+	q := *query
+	q.QueryString = statement
+	q.CacheDuration = 0
+	q.waitQueryExecutionIds = nil
+
+	if err := checkQueryGuardrails(q.dsInfo, q.QueryString); err != nil {
+		return nil, nil, err
+	}
+	workgroup, err := q.getWorkgroup(ctx, pluginContext, q.Region, q.WorkGroup)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := q.checkScanLimit(workgroup); err != nil {
+		return nil, nil, err
+	}
+	queryExecutionID, err := q.startQueryExecution(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := q.waitForQueryCompleted(ctx, q.waitQueryExecutionIds); err != nil {
+		q.stopQueryExecution(queryExecutionID)
+		return nil, nil, err
+	}
+	eo, err := q.client.GetQueryExecutionWithContext(ctx, &athena.GetQueryExecutionInput{QueryExecutionId: aws.String(queryExecutionID)})
+	if err != nil {
+		q.stopQueryExecution(queryExecutionID)
+		return nil, nil, err
+	}
+	switch aws.StringValue(eo.QueryExecution.Status.State) {
+	case athena.QueryExecutionStateSucceeded:
+	case athena.QueryExecutionStateFailed, athena.QueryExecutionStateCancelled:
+		return nil, nil, fmt.Errorf("query execution %s %s: %s", queryExecutionID, aws.StringValue(eo.QueryExecution.Status.State), aws.StringValue(eo.QueryExecution.Status.StateChangeReason))
+	default:
+		// the statement keeps running and billed after the wait
+		q.stopQueryExecution(queryExecutionID)
+		return nil, nil, fmt.Errorf("query execution %s is not completed in the wait, it is stopped", queryExecutionID)
+	}
+
+	lines := make([]string, 0)
+	var columnName string
+	err = q.client.GetQueryResultsPagesWithContext(ctx, &athena.GetQueryResultsInput{QueryExecutionId: aws.String(queryExecutionID)},
+		func(page *athena.GetQueryResultsOutput, lastPage bool) bool {
+			if columnName == "" && len(page.ResultSet.ResultSetMetadata.ColumnInfo) > 0 {
+				columnName = aws.StringValue(page.ResultSet.ResultSetMetadata.ColumnInfo[0].Name)
+			}
+			for _, row := range page.ResultSet.Rows {
+				if len(row.Data) == 0 || row.Data[0] == nil {
+					lines = append(lines, "")
+					continue
+				}
+				lines = append(lines, aws.StringValue(row.Data[0].VarCharValue))
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the result may include the header row
+	if len(lines) > 0 && lines[0] == columnName {
+		lines = lines[1:]
+	}
+	return lines, eo.QueryExecution, nil
+}
+
+// stopQueryExecution stops the query execution which isn't completed in the wait.
+// It doesn't use the request context, which may be cancelled already.
+func (query *AwsAthenaQuery) stopQueryExecution(queryExecutionID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := query.client.StopQueryExecutionWithContext(ctx, &athena.StopQueryExecutionInput{
+		QueryExecutionId: aws.String(queryExecutionID),
+	}); err != nil {
+		backend.Logger.Warn("Failed to stop query execution", "queryExecutionId", queryExecutionID, "error", err.Error())
+	}
+}
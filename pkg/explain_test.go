@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+func TestExplain(t *testing.T) {
+	t.Run("parseExplainIO", func(t *testing.T) {
+		plan := `{
+  "inputTableColumnInfos" : [ {
+    "table" : { "catalog" : "awsdatacatalog", "schemaTable" : { "schema" : "logs", "table" : "access" } },
+    "columnConstraints" : [ {
+      "columnName" : "dt",
+      "type" : "varchar",
+      "domain" : {
+        "nullsAllowed" : false,
+        "ranges" : [
+          { "low" : { "value" : "2020-01-01", "bound" : "EXACTLY" }, "high" : { "value" : "2020-01-01", "bound" : "EXACTLY" } },
+          { "low" : { "value" : "2020-01-02", "bound" : "ABOVE" }, "high" : { "bound" : "BELOW" } }
+        ]
+      }
+    } ],
+    "estimate" : { "outputRowCount" : "NaN", "outputSizeInBytes" : "NaN" }
+  } ]
+}`
+		tables, estimate, err := parseExplainIO(plan)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, (*int64)(nil), estimate)
+		assert.DeepEqual(t, []explainTable{{
+			Database:   "logs",
+			Table:      "access",
+			Partitions: []string{"dt = 2020-01-01", "dt > 2020-01-02"},
+		}}, tables)
+	})
+
+	t.Run("glueTableSize", func(t *testing.T) {
+		size, ok := glueTableSize(&glue.TableData{Parameters: map[string]*string{"sizeKey": aws.String("1024")}})
+		assert.Equal(t, true, ok)
+		assert.Equal(t, int64(1024), size)
+
+		_, ok = glueTableSize(&glue.TableData{Parameters: map[string]*string{}})
+		assert.Equal(t, false, ok)
+	})
+
+	t.Run("executeStatement stops the execution not completed in the wait", func(t *testing.T) {
+		fake, server := newFakeAthenaServer(t)
+		defer server.Close()
+		fake.state = "RUNNING"
+		ds := newTestDataSource()
+		pluginContext := backend.PluginContext{
+			OrgID: 1,
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				ID:       104,
+				JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `"}`),
+				DecryptedSecureJSONData: map[string]string{
+					"accessKey": "AKID",
+					"secretKey": "secret",
+				},
+			},
+		}
+		target, err := ds.newRegionTarget(pluginContext, AwsAthenaQuery{RefId: "A", WorkGroup: "primary"}, "default")
+		assert.NilError(t, err)
+		target.waitCount = 1
+		_, _, err = target.executeStatement(context.Background(), pluginContext, "EXPLAIN ANALYZE SELECT 1")
+		assert.Error(t, err, "query execution qid-1 is not completed in the wait, it is stopped")
+		assert.Equal(t, 1, fake.count("StopQueryExecution"))
+	})
+}
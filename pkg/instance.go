@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+)
+
+// awsAthenaInstance holds parsed settings and per region AWS clients of a datasource.
+// The instance manager creates a new instance when the datasource settings are updated.
+// The settings are shared by concurrent requests, so they are never modified after the instance is created.
+type awsAthenaInstance struct {
+	datasourceID int64
+	dsInfo       *DatasourceInfo
+	lock         sync.Mutex
+	clients      map[string]*awsClients
+	// keys of the credentials cache entries created for the instance
+	credentialsKeys map[string]bool
+}
+
+type awsClients struct {
+	credentials *credentials.Credentials
+	athena      *athena.Athena
+	ec2         *ec2.EC2
+	s3          *s3.S3
+	glue        *glue.Glue
+}
+
+func newDataSourceInstance(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	dsInfo, err := newDsInfo(&settings)
+	if err != nil {
+		return nil, err
+	}
+	return &awsAthenaInstance{
+		datasourceID:    settings.ID,
+		dsInfo:          dsInfo,
+		clients:         make(map[string]*awsClients),
+		credentialsKeys: make(map[string]bool),
+	}, nil
+}
+
+// Dispose is called when the datasource settings are updated, the credentials of the old settings are evicted
+// and the audit log file is closed.
+func (inst *awsAthenaInstance) Dispose() {
+	inst.lock.Lock()
+	keys := make([]string, 0, len(inst.credentialsKeys))
+	for key := range inst.credentialsKeys {
+		keys = append(keys, key)
+	}
+	inst.clients = make(map[string]*awsClients)
+	inst.credentialsKeys = make(map[string]bool)
+	inst.lock.Unlock()
+	defaultCredentialsCache.evict(keys)
+	defaultAuditLogger.close(inst.datasourceID)
+}
+
+// getDsInfo returns a copy of the datasource settings for the region.
+// The instance settings don't have org id, it is taken from the request.
+func (inst *awsAthenaInstance) getDsInfo(orgID int64, region string) *DatasourceInfo {
+	dsInfo := *inst.dsInfo
+	dsInfo.OrgID = orgID
+	if region == "default" || region == "" {
+		dsInfo.Region = dsInfo.DefaultRegion
+	} else {
+		dsInfo.Region = region
+	}
+	return &dsInfo
+}
+
+// getClients returns the clients for the region, clients are recreated when the credentials are replaced.
+func (inst *awsAthenaInstance) getClients(orgID int64, region string) (*awsClients, error) {
+	return inst.getRoleClients(orgID, region, "")
+}
+
+// getRoleClients returns the clients which assume the role, the role should be in the allow-list of the datasource.
+func (inst *awsAthenaInstance) getRoleClients(orgID int64, region string, assumeRoleArn string) (*awsClients, error) {
+	dsInfo := inst.getDsInfo(orgID, region)
+	if assumeRoleArn != "" {
+		var err error
+		if dsInfo, err = dsInfo.withAssumeRole(assumeRoleArn); err != nil {
+			return nil, err
+		}
+	}
+	cfg, err := getAwsConfig(dsInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	clientsKey := dsInfo.Region + "/" + assumeRoleArn
+	inst.lock.Lock()
+	defer inst.lock.Unlock()
+	inst.credentialsKeys[credentialsCacheKey(dsInfo)] = true
+	if c, ok := inst.clients[clientsKey]; ok && c.credentials == cfg.Credentials {
+		return c, nil
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s3Config := withEndpoint(cfg, dsInfo.S3Endpoint)
+	if dsInfo.S3Endpoint != "" {
+		// bucket name in host isn't resolvable with custom endpoint
+		s3Config = s3Config.WithS3ForcePathStyle(true)
+	}
+	c := &awsClients{
+		credentials: cfg.Credentials,
+		athena:      athena.New(sess, withEndpoint(cfg, dsInfo.AthenaEndpoint)),
+		ec2:         ec2.New(sess, withEndpoint(cfg, dsInfo.Ec2Endpoint)),
+		s3:          s3.New(sess, s3Config),
+		glue:        glue.New(sess, withEndpoint(cfg, dsInfo.GlueEndpoint)),
+	}
+	inst.clients[clientsKey] = c
+	return c, nil
+}
+
+func (ds *AwsAthenaDatasource) getInstance(pluginContext backend.PluginContext) (*awsAthenaInstance, error) {
+	i, err := ds.im.Get(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	inst, ok := i.(*awsAthenaInstance)
+	if !ok {
+		return nil, fmt.Errorf("unexpected instance type %T", i)
+	}
+	return inst, nil
+}
+
+func (ds *AwsAthenaDatasource) getDsInfo(pluginContext backend.PluginContext, region string) (*DatasourceInfo, error) {
+	inst, err := ds.getInstance(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	return inst.getDsInfo(pluginContext.OrgID, region), nil
+}
+
+func (ds *AwsAthenaDatasource) getClients(pluginContext backend.PluginContext, region string) (*awsClients, error) {
+	inst, err := ds.getInstance(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	return inst.getClients(pluginContext.OrgID, region)
+}
+
+func (ds *AwsAthenaDatasource) getClient(pluginContext backend.PluginContext, region string) (*athena.Athena, error) {
+	c, err := ds.getClients(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	return c.athena, nil
+}
+
+// getQueryClient returns the client for the query, which may assume the per query role.
+func (ds *AwsAthenaDatasource) getQueryClient(pluginContext backend.PluginContext, region string, assumeRoleArn string) (*athena.Athena, error) {
+	inst, err := ds.getInstance(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	c, err := inst.getRoleClients(pluginContext.OrgID, region, assumeRoleArn)
+	if err != nil {
+		return nil, err
+	}
+	return c.athena, nil
+}
+
+func (ds *AwsAthenaDatasource) getEC2Client(pluginContext backend.PluginContext, region string) (*ec2.EC2, error) {
+	c, err := ds.getClients(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	return c.ec2, nil
+}
+
+func (ds *AwsAthenaDatasource) getS3Client(pluginContext backend.PluginContext, region string) (*s3.S3, error) {
+	c, err := ds.getClients(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	return c.s3, nil
+}
+
+func (ds *AwsAthenaDatasource) getGlueClient(pluginContext backend.PluginContext, region string) (*glue.Glue, error) {
+	c, err := ds.getClients(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	return c.glue, nil
+}
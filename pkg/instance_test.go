@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"gotest.tools/assert"
+)
+
+func newTestInstance(t *testing.T) *awsAthenaInstance {
+	i, err := newDataSourceInstance(backend.DataSourceInstanceSettings{
+		ID:       1,
+		Name:     "Athena",
+		JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","allowedAssumeRoleArns":["arn:aws:iam::123456789012:role/allowed"]}`),
+		DecryptedSecureJSONData: map[string]string{
+			"accessKey": "AKID",
+			"secretKey": "secret",
+		},
+	})
+	assert.NilError(t, err)
+	return i.(*awsAthenaInstance)
+}
+
+func TestInstance(t *testing.T) {
+	t.Run("clients are reused per region and role", func(t *testing.T) {
+		inst := newTestInstance(t)
+		c1, err := inst.getClients(1, "default")
+		assert.NilError(t, err)
+		c2, err := inst.getClients(1, "us-east-1")
+		assert.NilError(t, err)
+		assert.Assert(t, c1 == c2)
+
+		other, err := inst.getClients(1, "us-west-2")
+		assert.NilError(t, err)
+		assert.Assert(t, c1 != other)
+
+		role1, err := inst.getRoleClients(1, "us-east-1", "arn:aws:iam::123456789012:role/allowed")
+		assert.NilError(t, err)
+		assert.Assert(t, c1 != role1)
+		role2, err := inst.getRoleClients(1, "us-east-1", "arn:aws:iam::123456789012:role/allowed")
+		assert.NilError(t, err)
+		assert.Assert(t, role1 == role2)
+	})
+
+	t.Run("clients are recreated when the credentials are replaced", func(t *testing.T) {
+		inst := newTestInstance(t)
+		c1, err := inst.getClients(1, "us-east-1")
+		assert.NilError(t, err)
+
+		defaultCredentialsCache.evict([]string{credentialsCacheKey(inst.getDsInfo(1, "us-east-1"))})
+
+		c2, err := inst.getClients(1, "us-east-1")
+		assert.NilError(t, err)
+		assert.Assert(t, c1 != c2)
+		assert.Assert(t, c1.credentials != c2.credentials)
+	})
+
+	t.Run("credentials are evicted on dispose", func(t *testing.T) {
+		inst := newTestInstance(t)
+		_, err := inst.getClients(1, "us-east-1")
+		assert.NilError(t, err)
+		key := credentialsCacheKey(inst.getDsInfo(1, "us-east-1"))
+		defaultCredentialsCache.lock.Lock()
+		_, ok := defaultCredentialsCache.entries[key]
+		defaultCredentialsCache.lock.Unlock()
+		assert.Assert(t, ok)
+
+		inst.Dispose()
+		defaultCredentialsCache.lock.Lock()
+		_, ok = defaultCredentialsCache.entries[key]
+		defaultCredentialsCache.lock.Unlock()
+		assert.Assert(t, !ok)
+		assert.Equal(t, 0, len(inst.clients))
+	})
+
+	t.Run("role not in the allow-list is rejected", func(t *testing.T) {
+		inst := newTestInstance(t)
+		_, err := inst.getRoleClients(1, "us-east-1", "arn:aws:iam::123456789012:role/other")
+		assert.Error(t, err, "assume role arn is not allowed in the datasource: arn:aws:iam::123456789012:role/other")
+		assert.Equal(t, 0, len(inst.clients))
+	})
+
+	t.Run("org id is set to the copy of the settings", func(t *testing.T) {
+		inst := newTestInstance(t)
+		var wg sync.WaitGroup
+		for i := int64(1); i <= 10; i++ {
+			wg.Add(1)
+			go func(orgID int64) {
+				defer wg.Done()
+				dsInfo := inst.getDsInfo(orgID, "default")
+				assert.Equal(t, orgID, dsInfo.OrgID)
+				assert.Equal(t, "us-east-1", dsInfo.Region)
+			}(i)
+		}
+		wg.Wait()
+		assert.Equal(t, int64(0), inst.dsInfo.OrgID)
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	FORMAT_LOGS        = "logs"
+	FORMAT_LOGS_VOLUME = "logs_volume"
+
+	// number of the log volume histogram buckets when the interval isn't given
+	LOGS_VOLUME_BUCKETS = 100
+	// default max rows of the log volume histogram, the rows are bounded by the buckets and levels
+	LOGS_VOLUME_DEFAULT_MAX_ROWS = 10000
+)
+
+var (
+	// candidates of the column names, the first matched column is used when the column isn't specified
+	logTimeColumns    = []string{"timestamp", "time", "@timestamp", "datetime", "date", "event_time"}
+	logMessageColumns = []string{"message", "msg", "body", "log", "line", "request"}
+	logLevelColumns   = []string{"level", "severity", "log_level", "loglevel", "lvl"}
+)
+
+// parseLogsResponse builds the frames for the logs visualization, one frame per label set.
+// The columns other than the time, message and level are the labels of the message field.
+func parseLogsResponse(resp *athena.GetQueryResultsOutput, refId string, timestampColumn string, messageColumn string, levelColumn string, timeFormat string) ([]*data.Frame, error) {
+	columns := resp.ResultSet.ResultSetMetadata.ColumnInfo
+
+	timeIndex, err := detectColumn(columns, timestampColumn, logTimeColumns, nil)
+	if err != nil {
+		return nil, err
+	}
+	if timeIndex == -1 {
+		timeIndex, _ = detectColumn(columns, "", nil, []string{"timestamp", "date"})
+	}
+	if timeIndex == -1 {
+		return nil, fmt.Errorf("time column not found, specify timestampColumn")
+	}
+	levelIndex, err := detectColumn(columns, levelColumn, logLevelColumns, nil, timeIndex)
+	if err != nil {
+		return nil, err
+	}
+	messageIndex, err := detectColumn(columns, messageColumn, logMessageColumns, nil, timeIndex, levelIndex)
+	if err != nil {
+		return nil, err
+	}
+	if messageIndex == -1 {
+		messageIndex, _ = detectColumn(columns, "", nil, []string{"varchar"}, timeIndex, levelIndex)
+	}
+	if messageIndex == -1 {
+		return nil, fmt.Errorf("message column not found, specify messageColumn")
+	}
+
+	timeConverter := timeColumnConverter(columns[timeIndex], timeFormat)
+
+	fm := make(map[string]*data.Frame)
+	for _, row := range resp.ResultSet.Rows {
+		cell := row.Data[timeIndex]
+		if cell == nil || cell.VarCharValue == nil {
+			continue
+		}
+		t, err := convertTime(timeConverter, *cell.VarCharValue)
+		if err != nil {
+			return nil, err
+		}
+
+		labels := data.Labels{}
+		for columnIdx, cell := range row.Data {
+			if columnIdx == timeIndex || columnIdx == messageIndex || columnIdx == levelIndex {
+				continue
+			}
+			if cell == nil || cell.VarCharValue == nil {
+				continue
+			}
+			labels[*columns[columnIdx].Name] = *cell.VarCharValue
+		}
+		key := labels.String()
+		frame, ok := fm[key]
+		if !ok {
+			messageField := data.NewField("line", labels, []string{})
+			frame = data.NewFrame("", data.NewField("ts", nil, []time.Time{}), messageField)
+			if levelIndex != -1 {
+				frame.Fields = append(frame.Fields, data.NewField("level", nil, []string{}))
+			}
+			frame.RefID = refId
+			frame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+			fm[key] = frame
+		}
+
+		newRow := []interface{}{*t, cellString(row.Data[messageIndex])}
+		if levelIndex != -1 {
+			newRow = append(newRow, normalizeLogLevel(cellString(row.Data[levelIndex])))
+		}
+		frame.AppendRow(newRow...)
+	}
+
+	keys := make([]string, 0, len(fm))
+	for key := range fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	frames := make([]*data.Frame, 0, len(keys))
+	for _, key := range keys {
+		frames = append(frames, fm[key])
+	}
+	return frames, nil
+}
+
+// detectColumn returns the index of the specified column, or the first column which name is in the candidates,
+// or the first column which type is in the types. The excluded columns are skipped. -1 is returned when not found.
+func detectColumn(columns []*athena.ColumnInfo, name string, candidates []string, types []string, excludes ...int) (int, error) {
+	if name != "" {
+		for i, c := range columns {
+			if *c.Name == name {
+				return i, nil
+			}
+		}
+		return -1, fmt.Errorf("column not found: %s", name)
+	}
+	excluded := func(i int) bool {
+		for _, e := range excludes {
+			if i == e {
+				return true
+			}
+		}
+		return false
+	}
+	for _, candidate := range candidates {
+		for i, c := range columns {
+			if !excluded(i) && strings.EqualFold(*c.Name, candidate) {
+				return i, nil
+			}
+		}
+	}
+	for _, t := range types {
+		for i, c := range columns {
+			if !excluded(i) && *c.Type == t {
+				return i, nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// timeColumnConverter returns the converter of the time column, varchar column is parsed with the time format.
+func timeColumnConverter(column *athena.ColumnInfo, timeFormat string) data.FieldConverter {
+	fc, ok := converterMap[*column.Type]
+	if !ok || *column.Type == "varchar" {
+		return genTimeFieldConverter(timeFormat)
+	}
+	return fc
+}
+
+func convertTime(fc data.FieldConverter, s string) (*time.Time, error) {
+	v, err := fc.Converter(s)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := v.(*time.Time)
+	if !ok {
+		return nil, fmt.Errorf("expected time input but got type %T", v)
+	}
+	return t, nil
+}
+
+func cellString(cell *athena.Datum) string {
+	if cell == nil || cell.VarCharValue == nil {
+		return ""
+	}
+	return *cell.VarCharValue
+}
+
+// normalizeLogLevel maps the level or the severity to the log level name of Grafana.
+// Numeric values are handled as the syslog severity.
+func normalizeLogLevel(level string) string {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "emerg", "emergency", "alert", "crit", "critical", "fatal", "panic", "0", "1", "2":
+		return "critical"
+	case "err", "error", "3":
+		return "error"
+	case "warn", "warning", "4":
+		return "warning"
+	case "notice", "info", "information", "informational", "5", "6":
+		return "info"
+	case "debug", "dbg", "7":
+		return "debug"
+	case "trace":
+		return "trace"
+	default:
+		return "unknown"
+	}
+}
+
+// logsVolumeQuery wraps the query to count the rows per time bucket and level, it is the log volume histogram of the logs query.
+func logsVolumeQuery(queryString string, timestampColumn string, levelColumn string, interval time.Duration) (string, error) {
+	if timestampColumn == "" {
+		return "", fmt.Errorf("logs volume requires timestampColumn")
+	}
+	seconds := int64(math.Max(math.Round(interval.Seconds()), 1))
+	bucket := fmt.Sprintf("from_unixtime(floor(to_unixtime(%s) / %d) * %d)", quoteIdentifier(timestampColumn), seconds, seconds)
+	inner, err := logsVolumeInnerQuery(queryString)
+	if err != nil {
+		return "", err
+	}
+	if levelColumn == "" {
+		return fmt.Sprintf("SELECT %s AS time, count(*) AS count FROM (%s) GROUP BY 1 ORDER BY 1", bucket, inner), nil
+	}
+	return fmt.Sprintf("SELECT %s AS time, %s AS level, count(*) AS count FROM (%s) GROUP BY 1, 2 ORDER BY 1", bucket, quoteIdentifier(levelColumn), inner), nil
+}
+
+// logsVolumeInnerQuery cuts the trailing comments, semicolon, ORDER BY and LIMIT of the query, to be the subquery of the histogram.
+// A trailing line comment would comment out the closing parenthesis, and LIMIT would count only a part of the rows.
+func logsVolumeInnerQuery(queryString string) (string, error) {
+	tokens, err := tokenizeSQL(queryString)
+	if err != nil {
+		return "", err
+	}
+	end := 0
+	depth := 0
+	for i, t := range tokens {
+		if depth == 0 && (t.isSymbol(";") || t.isKeyword("LIMIT") || t.isKeyword("OFFSET") ||
+			(t.isKeyword("ORDER") && i+1 < len(tokens) && tokens[i+1].isKeyword("BY"))) {
+			break
+		}
+		if t.isSymbol("(") {
+			depth++
+		} else if t.isSymbol(")") {
+			depth--
+		}
+		end = t.end
+	}
+	return queryString[:end], nil
+}
+
+// logsVolumeInterval returns the bucket width of the log volume histogram.
+func logsVolumeInterval(interval time.Duration, from time.Time, to time.Time) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	return to.Sub(from) / LOGS_VOLUME_BUCKETS
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
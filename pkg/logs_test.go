@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gotest.tools/assert"
+)
+
+func TestLogs(t *testing.T) {
+	t.Run("parseLogsResponse", func(t *testing.T) {
+		resp := &athena.GetQueryResultsOutput{
+			ResultSet: &athena.ResultSet{
+				ResultSetMetadata: &athena.ResultSetMetadata{
+					ColumnInfo: []*athena.ColumnInfo{
+						{Name: aws.String("event_time"), Type: aws.String("timestamp")},
+						{Name: aws.String("Severity"), Type: aws.String("varchar")},
+						{Name: aws.String("host"), Type: aws.String("varchar")},
+						{Name: aws.String("msg"), Type: aws.String("varchar")},
+					},
+				},
+				Rows: []*athena.Row{
+					{Data: []*athena.Datum{{VarCharValue: aws.String("2021-01-01 00:00:00.000")}, {VarCharValue: aws.String("ERR")}, {VarCharValue: aws.String("a")}, {VarCharValue: aws.String("failed")}}},
+					{Data: []*athena.Datum{{VarCharValue: aws.String("2021-01-01 00:00:01.000")}, {VarCharValue: aws.String("6")}, {VarCharValue: aws.String("b")}, {VarCharValue: aws.String("started")}}},
+					{Data: []*athena.Datum{{VarCharValue: aws.String("2021-01-01 00:00:02.000")}, {VarCharValue: aws.String("info")}, {VarCharValue: aws.String("a")}, {}}},
+					{Data: []*athena.Datum{{}, {VarCharValue: aws.String("info")}, {VarCharValue: aws.String("a")}, {VarCharValue: aws.String("no time")}}},
+				},
+			},
+		}
+		frames, err := parseLogsResponse(resp, "A", "", "", "", time.RFC3339Nano)
+		assert.NilError(t, err)
+		assert.Equal(t, 2, len(frames))
+
+		frame := frames[0]
+		assert.Equal(t, "A", frame.RefID)
+		assert.Equal(t, data.VisType(data.VisTypeLogs), frame.Meta.PreferredVisualization)
+		assert.Equal(t, 2, frame.Rows())
+		assert.DeepEqual(t, data.Labels{"host": "a"}, frame.Fields[1].Labels)
+		assert.Equal(t, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), frame.Fields[0].At(0))
+		assert.Equal(t, "failed", frame.Fields[1].At(0))
+		assert.Equal(t, "error", frame.Fields[2].At(0))
+		assert.Equal(t, "", frame.Fields[1].At(1))
+		assert.Equal(t, "info", frames[1].Fields[2].At(0))
+
+		_, err = parseLogsResponse(resp, "A", "", "body", "", time.RFC3339Nano)
+		assert.Error(t, err, "column not found: body")
+	})
+
+	t.Run("normalizeLogLevel", func(t *testing.T) {
+		assert.Equal(t, "critical", normalizeLogLevel("FATAL"))
+		assert.Equal(t, "warning", normalizeLogLevel(" warn "))
+		assert.Equal(t, "debug", normalizeLogLevel("7"))
+		assert.Equal(t, "unknown", normalizeLogLevel("200"))
+	})
+
+	t.Run("logsVolumeQuery", func(t *testing.T) {
+		q, err := logsVolumeQuery("SELECT * FROM logs;", "ts", "", 90*time.Second)
+		assert.NilError(t, err)
+		assert.Equal(t, `SELECT from_unixtime(floor(to_unixtime("ts") / 90) * 90) AS time, count(*) AS count FROM (SELECT * FROM logs) GROUP BY 1 ORDER BY 1`, q)
+
+		q, err = logsVolumeQuery("SELECT * FROM logs", "ts", "level", 0)
+		assert.NilError(t, err)
+		assert.Equal(t, `SELECT from_unixtime(floor(to_unixtime("ts") / 1) * 1) AS time, "level" AS level, count(*) AS count FROM (SELECT * FROM logs) GROUP BY 1, 2 ORDER BY 1`, q)
+
+		q, err = logsVolumeQuery("SELECT * FROM logs -- recent logs", "ts", "", time.Minute)
+		assert.NilError(t, err)
+		assert.Equal(t, `SELECT from_unixtime(floor(to_unixtime("ts") / 60) * 60) AS time, count(*) AS count FROM (SELECT * FROM logs) GROUP BY 1 ORDER BY 1`, q)
+
+		_, err = logsVolumeQuery("SELECT * FROM logs", "", "", time.Minute)
+		assert.Error(t, err, "logs volume requires timestampColumn")
+
+		for input, expected := range map[string]string{
+			"SELECT * FROM logs ORDER BY ts DESC LIMIT 100;":                          "SELECT * FROM logs",
+			"SELECT * FROM logs\nLIMIT 100 -- first rows":                             "SELECT * FROM logs",
+			"SELECT * FROM logs /* recent */ ORDER BY ts DESC":                        "SELECT * FROM logs",
+			"SELECT * FROM (SELECT * FROM logs ORDER BY ts LIMIT 10) WHERE msg = ';'": "SELECT * FROM (SELECT * FROM logs ORDER BY ts LIMIT 10) WHERE msg = ';'",
+			"SELECT row_number() OVER (ORDER BY ts) AS n, msg FROM logs LIMIT 5":      "SELECT row_number() OVER (ORDER BY ts) AS n, msg FROM logs",
+		} {
+			inner, err := logsVolumeInnerQuery(input)
+			assert.NilError(t, err)
+			assert.Equal(t, expected, inner)
+		}
+
+		from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		assert.Equal(t, 36*time.Second, logsVolumeInterval(0, from, from.Add(time.Hour)))
+		assert.Equal(t, time.Minute, logsVolumeInterval(time.Minute, from, from.Add(time.Hour)))
+	})
+}
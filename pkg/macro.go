@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// macroPattern matches the start of the macro, the arguments are read with balanced parentheses.
+var macroPattern = regexp.MustCompile(`\$__(\w+)\(`)
+
+// errUnknownMacro is returned for the macro which is not defined here, the text is left as it is.
+var errUnknownMacro = errors.New("unknown macro")
+
+// expandMacros replaces the time range and the template variable macros in the query string.
+// Athena evaluates the timestamp literals in UTC. Unknown macros are left untouched.
+func expandMacros(queryString string, from time.Time, to time.Time, variables map[string][]string) (string, error) {
+	var sb strings.Builder
+	rest := queryString
+	for {
+		loc := macroPattern.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			sb.WriteString(rest)
+			break
+		}
+		sb.WriteString(rest[:loc[0]])
+		name := rest[loc[2]:loc[3]]
+		args, n, ok := readMacroArgs(rest[loc[1]:])
+		if !ok {
+			// the parentheses are not closed, left as it is
+			sb.WriteString(rest[loc[0]:loc[1]])
+			rest = rest[loc[1]:]
+			continue
+		}
+		expanded, err := expandMacro(name, args, from.UTC(), to.UTC(), variables)
+		if err == errUnknownMacro {
+			// the macros in the arguments of the unknown macro are expanded
+			sb.WriteString(rest[loc[0]:loc[1]])
+			rest = rest[loc[1]:]
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(expanded)
+		rest = rest[loc[1]+n:]
+	}
+	return sb.String(), nil
+}
+
+// readMacroArgs reads the comma separated arguments until the closing parenthesis, and returns the length including it.
+// The commas and parentheses in the nested parentheses and the quoted strings are the part of the argument.
+func readMacroArgs(s string) ([]string, int, bool) {
+	args := make([]string, 0)
+	appendArg := func(arg string) {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	depth := 0
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\'', '"', '`':
+			end := strings.IndexByte(s[i+1:], c)
+			if end == -1 {
+				return nil, 0, false
+			}
+			i += end + 1
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				appendArg(s[start:i])
+				return args, i + 1, true
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				appendArg(s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+func expandMacro(name string, args []string, from time.Time, to time.Time, variables map[string][]string) (string, error) {
+	timestamp := func(t time.Time) string {
+		return "TIMESTAMP '" + t.Format("2006-01-02 15:04:05.000") + "'"
+	}
+	date := func(t time.Time) string {
+		return "DATE '" + t.Format("2006-01-02") + "'"
+	}
+	column := func() (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("macro $__%s should have a column argument", name)
+		}
+		return args[0], nil
+	}
+	// the values of the template variable are passed from the frontend, they are quoted here to be safe
+	variable := func(single bool) ([]string, error) {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("macro $__%s should have a variable argument", name)
+		}
+		values, ok := variables[strings.TrimPrefix(args[0], "$")]
+		if !ok {
+			return nil, fmt.Errorf("variable not found: %s", args[0])
+		}
+		if single && len(values) != 1 {
+			return nil, fmt.Errorf("macro $__%s requires single value, but variable %s has %d values", name, args[0], len(values))
+		}
+		return values, nil
+	}
+
+	switch name {
+	case "timeFilter":
+		c, err := column()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s", c, timestamp(from), timestamp(to)), nil
+	case "timeFrom":
+		return timestamp(from), nil
+	case "timeTo":
+		return timestamp(to), nil
+	case "dateFilter":
+		c, err := column()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s", c, date(from), date(to)), nil
+	case "unixEpochFilter":
+		c, err := column()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s BETWEEN %d AND %d", c, from.Unix(), to.Unix()), nil
+	case "unixEpochFrom":
+		return strconv.FormatInt(from.Unix(), 10), nil
+	case "unixEpochTo":
+		return strconv.FormatInt(to.Unix(), 10), nil
+	case "in":
+		values, err := variable(false)
+		if err != nil {
+			return "", err
+		}
+		if len(values) == 0 {
+			// matches nothing, "IN ()" is a syntax error
+			return "(NULL)", nil
+		}
+		literals := make([]string, 0, len(values))
+		for _, v := range values {
+			literals = append(literals, quoteLiteral(v))
+		}
+		return "(" + strings.Join(literals, ", ") + ")", nil
+	case "value":
+		values, err := variable(true)
+		if err != nil {
+			return "", err
+		}
+		return quoteLiteral(values[0]), nil
+	case "ident":
+		values, err := variable(true)
+		if err != nil {
+			return "", err
+		}
+		if values[0] == "" {
+			return "", fmt.Errorf("variable %s is empty", args[0])
+		}
+		// qualified name, e.g. database.table
+		parts := strings.Split(values[0], ".")
+		for i, p := range parts {
+			parts[i] = quoteIdentifier(p)
+		}
+		return strings.Join(parts, "."), nil
+	}
+	return "", errUnknownMacro
+}
+
+// truncateTimeRange aligns the time range to the query interval, or to the minute for the shorter interval,
+// so that the expanded query string, which is a part of the cache key, stays same over the dashboard refreshes.
+// The start is rounded down and the end is rounded up not to miss the latest data.
+func truncateTimeRange(from time.Time, to time.Time, interval time.Duration) (time.Time, time.Time) {
+	if interval < time.Minute {
+		interval = time.Minute
+	}
+	truncatedTo := to.Truncate(interval)
+	if truncatedTo.Before(to) {
+		truncatedTo = truncatedTo.Add(interval)
+	}
+	return from.Truncate(interval), truncatedTo
+}
+
+// quoteLiteral quotes the string literal, Presto doesn't use the backslash escape.
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
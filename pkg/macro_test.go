@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestExpandMacros(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	result, err := expandMacros("SELECT * FROM t WHERE $__timeFilter(ts) AND $__dateFilter( dt ) AND epoch > $__unixEpochFrom()", from, to, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "SELECT * FROM t WHERE ts BETWEEN TIMESTAMP '2020-01-01 00:00:00.000' AND TIMESTAMP '2020-01-02 03:04:05.000' AND dt BETWEEN DATE '2020-01-01' AND DATE '2020-01-02' AND epoch > 1577836800", result)
+
+	_, err = expandMacros("SELECT $__timeFilter()", from, to, nil)
+	assert.Error(t, err, "macro $__timeFilter should have a column argument")
+	result, err = expandMacros("SELECT $__unknown(a, b) FROM t WHERE $__timeFilter(ts)", from, to, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "SELECT $__unknown(a, b) FROM t WHERE ts BETWEEN TIMESTAMP '2020-01-01 00:00:00.000' AND TIMESTAMP '2020-01-02 03:04:05.000'", result)
+
+	result, err = expandMacros("SELECT * FROM t WHERE $__timeFilter(from_iso8601_timestamp(ts)) AND $__dateFilter(date_parse(dt, '%Y-%m-%d)'))", from, to, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "SELECT * FROM t WHERE from_iso8601_timestamp(ts) BETWEEN TIMESTAMP '2020-01-01 00:00:00.000' AND TIMESTAMP '2020-01-02 03:04:05.000' AND date_parse(dt, '%Y-%m-%d)') BETWEEN DATE '2020-01-01' AND DATE '2020-01-02'", result)
+	_, err = expandMacros("SELECT $__timeFilter(ts, from_unixtime(x))", from, to, nil)
+	assert.Error(t, err, "macro $__timeFilter should have a column argument")
+
+	result, err = expandMacros("SELECT $__unknown($__timeFrom()) FROM t WHERE $__timeFilter(ts", from, to, nil)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "SELECT $__unknown(TIMESTAMP '2020-01-01 00:00:00.000') FROM t WHERE $__timeFilter(ts", result)
+}
+
+func TestTruncateTimeRange(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 12, 345000000, time.UTC)
+	to := time.Date(2020, 1, 1, 6, 0, 12, 345000000, time.UTC)
+
+	f, e := truncateTimeRange(from, to, 0)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), f)
+	assert.Equal(t, time.Date(2020, 1, 1, 6, 1, 0, 0, time.UTC), e)
+
+	// the refresh in the same interval renders the same query string
+	f2, e2 := truncateTimeRange(from.Add(30*time.Second), to.Add(30*time.Second), 0)
+	assert.Equal(t, f, f2)
+	assert.Equal(t, e, e2)
+
+	f, e = truncateTimeRange(from, to, 5*time.Minute)
+	assert.Equal(t, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), f)
+	assert.Equal(t, time.Date(2020, 1, 1, 6, 5, 0, 0, time.UTC), e)
+
+	aligned := time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC)
+	_, e = truncateTimeRange(from, aligned, 0)
+	assert.Equal(t, aligned, e)
+}
+
+func TestExpandVariableMacros(t *testing.T) {
+	from := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	variables := map[string][]string{
+		"host":   {"web-1", "it's"},
+		"tenant": {"a"},
+		"none":   {},
+		"column": {`status"code`},
+		"table":  {"logs.access"},
+	}
+
+	result, err := expandMacros("SELECT $__ident(column) FROM $__ident(table) WHERE host IN $__in(host) AND tenant = $__value(tenant) AND region IN $__in(none)", from, to, variables)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `SELECT "status""code" FROM "logs"."access" WHERE host IN ('web-1', 'it''s') AND tenant = 'a' AND region IN (NULL)`, result)
+
+	result, err = expandMacros("SELECT * FROM logs WHERE host IN $__in($host)", from, to, variables)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `SELECT * FROM logs WHERE host IN ('web-1', 'it''s')`, result)
+
+	_, err = expandMacros("SELECT $__in(unknown)", from, to, variables)
+	assert.Error(t, err, "variable not found: unknown")
+	_, err = expandMacros("SELECT $__in()", from, to, variables)
+	assert.Error(t, err, "macro $__in should have a variable argument")
+	_, err = expandMacros("SELECT $__ident(host)", from, to, variables)
+	assert.Error(t, err, "macro $__ident requires single value, but variable host has 2 values")
+	_, err = expandMacros("SELECT $__value(tenant)", from, to, nil)
+	assert.Error(t, err, "variable not found: tenant")
+}
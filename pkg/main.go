@@ -6,20 +6,31 @@ import (
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
 )
 
 func main() {
 	backend.SetupPluginEnvironment("mtanda-aws-athena-datasource")
 
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		backend.Logger.Warn("Tracing Warning", "warn", err.Error())
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
 	mux := http.NewServeMux()
 	ds := NewDataSource(mux)
-	httpResourceHandler := httpadapter.New(mux)
+	httpResourceHandler := httpadapter.New(ds.prewarm.registerHandler(mux))
 
-	err := backend.Serve(backend.ServeOpts{
+	err = backend.Serve(backend.ServeOpts{
 		CallResourceHandler: httpResourceHandler,
 		QueryDataHandler:    ds,
 		CheckHealthHandler:  ds,
+		StreamHandler:       ds,
 	})
+	if err := shutdownTracing(context.Background()); err != nil {
+		backend.Logger.Warn("Tracing Warning", "warn", err.Error())
+	}
 	if err != nil {
 		backend.Logger.Error(err.Error())
 		os.Exit(1)
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricNamespace = "aws_athena_datasource"
+
+var (
+	// seconds, 0.1s to about 7 minutes
+	queryDurationBuckets = prometheus.ExponentialBuckets(0.1, 2, 13)
+	// Athena prefixes the failure reason with the error code, e.g. "SYNTAX_ERROR: line 1:8: ..."
+	stateChangeReasonCodePattern = regexp.MustCompile(`^([A-Z][A-Z0-9_]+):`)
+)
+
+type AwsAthenaMetrics struct {
+	resultPagesTotal         *prometheus.CounterVec
+	dataScannedBytesTotal    *prometheus.CounterVec
+	queryDuration            *prometheus.HistogramVec
+	queueTime                *prometheus.HistogramVec
+	engineExecutionTime      *prometheus.HistogramVec
+	executionsStartedTotal   *prometheus.CounterVec
+	executionFailuresTotal   *prometheus.CounterVec
+	executionsCancelledTotal *prometheus.CounterVec
+	executionTimeoutsTotal   *prometheus.CounterVec
+	cacheRequestsTotal       *prometheus.CounterVec
+}
+
+func newAwsAthenaMetrics() *AwsAthenaMetrics {
+	return &AwsAthenaMetrics{
+		resultPagesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "result_pages_total",
+				Help:      "query result page counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup"},
+		),
+		dataScannedBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "data_scanned_bytes_total",
+				Help:      "scanned data size counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup"},
+		),
+		queryDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:      "query_duration_seconds",
+				Help:      "end-to-end query latency, including waiting for query executions and fetching results",
+				Namespace: metricNamespace,
+				Buckets:   queryDurationBuckets,
+			},
+			[]string{"region", "workgroup"},
+		),
+		queueTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:      "query_execution_queue_time_seconds",
+				Help:      "time of query executions in the Athena queue",
+				Namespace: metricNamespace,
+				Buckets:   queryDurationBuckets,
+			},
+			[]string{"region", "workgroup"},
+		),
+		engineExecutionTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:      "query_execution_engine_time_seconds",
+				Help:      "engine execution time of query executions",
+				Namespace: metricNamespace,
+				Buckets:   queryDurationBuckets,
+			},
+			[]string{"region", "workgroup"},
+		),
+		executionsStartedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "query_executions_started_total",
+				Help:      "started query execution counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup"},
+		),
+		executionFailuresTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "query_execution_failures_total",
+				Help:      "failed query execution counter, state is START_FAILED when the query execution couldn't be started",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup", "state", "error_code"},
+		),
+		executionsCancelledTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "query_executions_cancelled_total",
+				Help:      "cancelled query execution counter",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup"},
+		),
+		executionTimeoutsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "query_execution_timeouts_total",
+				Help:      "counter of query executions which weren't completed in the wait time",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup"},
+		),
+		cacheRequestsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:      "cache_requests_total",
+				Help:      "cache lookup counter by cache type and result (hit or miss)",
+				Namespace: metricNamespace,
+			},
+			[]string{"region", "workgroup", "cache_type", "result"},
+		),
+	}
+}
+
+func (m *AwsAthenaMetrics) register() {
+	prometheus.MustRegister(m.resultPagesTotal)
+	prometheus.MustRegister(m.dataScannedBytesTotal)
+	prometheus.MustRegister(m.queryDuration)
+	prometheus.MustRegister(m.queueTime)
+	prometheus.MustRegister(m.engineExecutionTime)
+	prometheus.MustRegister(m.executionsStartedTotal)
+	prometheus.MustRegister(m.executionFailuresTotal)
+	prometheus.MustRegister(m.executionsCancelledTotal)
+	prometheus.MustRegister(m.executionTimeoutsTotal)
+	prometheus.MustRegister(m.cacheRequestsTotal)
+}
+
+func (query *AwsAthenaQuery) observeCache(cacheType string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	query.metrics.cacheRequestsTotal.WithLabelValues(query.Region, query.WorkGroup, cacheType, result).Inc()
+}
+
+// observeExecution records the statistics of the completed query execution.
+func (query *AwsAthenaQuery) observeExecution(e *athena.QueryExecution) {
+	workGroup := query.WorkGroup
+	if e.WorkGroup != nil {
+		workGroup = *e.WorkGroup
+	}
+	if e.Statistics != nil {
+		if e.Statistics.DataScannedInBytes != nil {
+			query.metrics.dataScannedBytesTotal.WithLabelValues(query.Region, workGroup).Add(float64(*e.Statistics.DataScannedInBytes))
+		}
+		if e.Statistics.QueryQueueTimeInMillis != nil {
+			query.metrics.queueTime.WithLabelValues(query.Region, workGroup).Observe(float64(*e.Statistics.QueryQueueTimeInMillis) / 1000)
+		}
+		if e.Statistics.EngineExecutionTimeInMillis != nil {
+			query.metrics.engineExecutionTime.WithLabelValues(query.Region, workGroup).Observe(float64(*e.Statistics.EngineExecutionTimeInMillis) / 1000)
+		}
+	}
+	if e.Status == nil {
+		return
+	}
+	switch aws.StringValue(e.Status.State) {
+	case athena.QueryExecutionStateFailed:
+		query.metrics.executionFailuresTotal.WithLabelValues(query.Region, workGroup, athena.QueryExecutionStateFailed, stateChangeReasonCode(aws.StringValue(e.Status.StateChangeReason))).Inc()
+	case athena.QueryExecutionStateCancelled:
+		query.metrics.executionsCancelledTotal.WithLabelValues(query.Region, workGroup).Inc()
+	}
+}
+
+func stateChangeReasonCode(reason string) string {
+	if m := stateChangeReasonCodePattern.FindStringSubmatch(reason); m != nil {
+		return m[1]
+	}
+	return "UNKNOWN"
+}
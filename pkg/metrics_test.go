@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gotest.tools/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	query := &AwsAthenaQuery{Region: "us-east-1", WorkGroup: "primary", metrics: newAwsAthenaMetrics()}
+
+	query.observeExecution(&athena.QueryExecution{
+		WorkGroup:  aws.String("primary"),
+		Statistics: &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(100), QueryQueueTimeInMillis: aws.Int64(1500)},
+		Status:     &athena.QueryExecutionStatus{State: aws.String("FAILED"), StateChangeReason: aws.String("SYNTAX_ERROR: line 1:8: Column 'x' cannot be resolved")},
+	})
+	query.observeExecution(&athena.QueryExecution{
+		Status: &athena.QueryExecutionStatus{State: aws.String("CANCELLED")},
+	})
+	query.observeCache("QueryResults", true)
+
+	assert.Equal(t, float64(100), testutil.ToFloat64(query.metrics.dataScannedBytesTotal.WithLabelValues("us-east-1", "primary")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(query.metrics.executionFailuresTotal.WithLabelValues("us-east-1", "primary", "FAILED", "SYNTAX_ERROR")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(query.metrics.executionsCancelledTotal.WithLabelValues("us-east-1", "primary")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(query.metrics.cacheRequestsTotal.WithLabelValues("us-east-1", "primary", "QueryResults", "hit")))
+	assert.Equal(t, "UNKNOWN", stateChangeReasonCode("Query exhausted resources at this scale factor"))
+}
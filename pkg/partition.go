@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+)
+
+const PARTITION_VALUES_CACHE_DURATION = 5 * time.Minute
+
+// partitionQuery lists the values of the partition key through Glue GetPartitions, without scanning the data.
+type partitionQuery struct {
+	Region     string
+	Database   string
+	Table      string
+	Key        string
+	Expression string // the Glue partition filter expression, e.g. "dt >= '2021-01-01'"
+	Order      string // asc or desc
+}
+
+func (pq partitionQuery) cacheKey(datasourceID int64) string {
+	return "PartitionValues/" + strconv.FormatInt(datasourceID, 10) + "/" + pq.Region + "/" + queryHash(strings.Join([]string{pq.Database, pq.Table, pq.Key, pq.Expression, pq.Order}, "/"))
+}
+
+func (ds *AwsAthenaDatasource) handleResourcePartitionValues(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	urlQuery := req.URL.Query()
+	pq := partitionQuery{
+		Region:     urlQuery.Get("region"),
+		Database:   urlQuery.Get("database"),
+		Table:      urlQuery.Get("table"),
+		Key:        urlQuery.Get("key"),
+		Expression: urlQuery.Get("expression"),
+		Order:      urlQuery.Get("order"),
+	}
+	if pq.Region == "" {
+		pq.Region = "default"
+	}
+
+	values, err := ds.getPartitionKeyValues(ctx, pluginContext, pq)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	writeResult(rw, "partition_values", values, nil)
+}
+
+// getPartitionKeyValues returns the distinct values of the partition key in the partitions which match the expression.
+func (ds *AwsAthenaDatasource) getPartitionKeyValues(ctx context.Context, pluginContext backend.PluginContext, pq partitionQuery) ([]string, error) {
+	if pq.Database == "" || pq.Table == "" || pq.Key == "" {
+		return nil, fmt.Errorf("database, table and key should be set")
+	}
+	if err := checkPartitionOrder(pq.Order); err != nil {
+		return nil, err
+	}
+
+	cacheKey := pq.cacheKey(pluginContext.DataSourceInstanceSettings.ID)
+	if item, _, found := ds.cache.GetWithExpiration(cacheKey); found {
+		if values, ok := item.([]string); ok {
+			return values, nil
+		}
+	}
+
+	keys, partitions, err := ds.getPartitions(ctx, pluginContext, pq.Region, pq.Database, pq.Table, pq.Expression)
+	if err != nil {
+		return nil, err
+	}
+	keyIndex := -1
+	for i, k := range keys {
+		if strings.EqualFold(k, pq.Key) {
+			keyIndex = i
+		}
+	}
+	if keyIndex == -1 {
+		return nil, fmt.Errorf("partition key not found: %s", pq.Key)
+	}
+
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, p := range partitions {
+		if keyIndex >= len(p) || seen[p[keyIndex]] {
+			continue
+		}
+		seen[p[keyIndex]] = true
+		values = append(values, p[keyIndex])
+	}
+	sortPartitionValues(values, pq.Order)
+	ds.cache.Set(cacheKey, values, PARTITION_VALUES_CACHE_DURATION)
+
+	return values, nil
+}
+
+// getPartitionValues returns the partitions of the table in "key1=value1/key2=value2" form.
+func (ds *AwsAthenaDatasource) getPartitionValues(ctx context.Context, pluginContext backend.PluginContext, region string, database string, table string, expression string) ([]string, error) {
+	keys, partitions, err := ds.getPartitions(ctx, pluginContext, region, database, table, expression)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		kv := make([]string, 0, len(p))
+		for i, v := range p {
+			if i < len(keys) {
+				kv = append(kv, keys[i]+"="+v)
+			}
+		}
+		values = append(values, strings.Join(kv, "/"))
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
+// getPartitions returns the partition keys of the table, and the values of the partitions which match the expression.
+func (ds *AwsAthenaDatasource) getPartitions(ctx context.Context, pluginContext backend.PluginContext, region string, database string, table string, expression string) ([]string, [][]string, error) {
+	svc, err := ds.getGlueClient(pluginContext, region)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := svc.GetTableWithContext(ctx, &glue.GetTableInput{
+		DatabaseName: aws.String(database),
+		Name:         aws.String(table),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(to.Table.PartitionKeys))
+	for _, c := range to.Table.PartitionKeys {
+		keys = append(keys, aws.StringValue(c.Name))
+	}
+
+	input := &glue.GetPartitionsInput{
+		DatabaseName:        aws.String(database),
+		TableName:           aws.String(table),
+		ExcludeColumnSchema: aws.Bool(true),
+	}
+	if expression != "" {
+		input.Expression = aws.String(expression)
+	}
+	partitions := make([][]string, 0)
+	err = svc.GetPartitionsPagesWithContext(ctx, input,
+		func(page *glue.GetPartitionsOutput, lastPage bool) bool {
+			for _, p := range page.Partitions {
+				partitions = append(partitions, aws.StringValueSlice(p.Values))
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, partitions, nil
+}
+
+func checkPartitionOrder(order string) error {
+	switch strings.ToLower(order) {
+	case "", "asc", "desc":
+		return nil
+	default:
+		return fmt.Errorf("invalid order: %s, should be asc or desc", order)
+	}
+}
+
+// sortPartitionValues sorts the values in the order, the values are compared as numbers if all values are numeric.
+func sortPartitionValues(values []string, order string) {
+	numbers := make([]float64, len(values))
+	numeric := true
+	for i, v := range values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			numeric = false
+			break
+		}
+		numbers[i] = f
+	}
+	if numeric {
+		sort.Sort(numericPartitionValues{values, numbers})
+	} else {
+		sort.Strings(values)
+	}
+	if strings.ToLower(order) == "desc" {
+		for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+			values[i], values[j] = values[j], values[i]
+		}
+	}
+}
+
+type numericPartitionValues struct {
+	values  []string
+	numbers []float64
+}
+
+func (v numericPartitionValues) Len() int           { return len(v.values) }
+func (v numericPartitionValues) Less(i, j int) bool { return v.numbers[i] < v.numbers[j] }
+func (v numericPartitionValues) Swap(i, j int) {
+	v.values[i], v.values[j] = v.values[j], v.values[i]
+	v.numbers[i], v.numbers[j] = v.numbers[j], v.numbers[i]
+}
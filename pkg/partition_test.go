@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestPartition(t *testing.T) {
+	t.Run("sortPartitionValues", func(t *testing.T) {
+		values := []string{"2021-01-02", "2021-01-10", "2021-01-01"}
+		sortPartitionValues(values, "")
+		assert.DeepEqual(t, []string{"2021-01-01", "2021-01-02", "2021-01-10"}, values)
+		sortPartitionValues(values, "desc")
+		assert.DeepEqual(t, []string{"2021-01-10", "2021-01-02", "2021-01-01"}, values)
+
+		values = []string{"9", "10", "1"}
+		sortPartitionValues(values, "asc")
+		assert.DeepEqual(t, []string{"1", "9", "10"}, values)
+
+		values = []string{"9", "10", "a"}
+		sortPartitionValues(values, "asc")
+		assert.DeepEqual(t, []string{"10", "9", "a"}, values)
+	})
+
+	t.Run("checkPartitionOrder", func(t *testing.T) {
+		assert.NilError(t, checkPartitionOrder(""))
+		assert.NilError(t, checkPartitionOrder("DESC"))
+		assert.Error(t, checkPartitionOrder("random"), "invalid order: random, should be asc or desc")
+	})
+
+	t.Run("cacheKey", func(t *testing.T) {
+		pq := partitionQuery{Region: "us-east-1", Database: "logs", Table: "access", Key: "dt"}
+		entry, ok := parseCacheKey(pq.cacheKey(1), 1)
+		assert.Assert(t, ok)
+		assert.Equal(t, "PartitionValues", entry.Type)
+		assert.Equal(t, "us-east-1", entry.Region)
+		assert.Assert(t, entry.QueryHash != "")
+
+		pq.Order = "desc"
+		assert.Assert(t, pq.cacheKey(1) != entry.Key)
+	})
+
+	t.Run("parseVariableQuery partition_values", func(t *testing.T) {
+		vq, err := parseVariableQuery("partition_values(us-east-1, logs, access, tenant, desc, dt >= '2021-01-01' AND tenant IN ('a', 'b'))")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"us-east-1", "logs", "access", "tenant", "desc", "dt >= '2021-01-01' AND tenant IN ('a', 'b')"}, vq.Args)
+
+		vq, err = parseVariableQuery("partitions(us-east-1, logs, access)")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"us-east-1", "logs", "access"}, vq.Args)
+		assert.Equal(t, "", vq.arg(3, ""))
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+)
+
+// PrewarmQuery is a query which is periodically run in background to keep the cache hot.
+type PrewarmQuery struct {
+	Schedule string          `json:"schedule"`
+	Range    Duration        `json:"range"`
+	Query    json.RawMessage `json:"query"`
+}
+
+// prewarmScheduler runs the prewarm queries of the datasources which were seen by the plugin.
+// Grafana doesn't send datasource settings until a request arrives, so datasources are registered on requests.
+type prewarmScheduler struct {
+	ds             *AwsAthenaDatasource
+	lock           sync.Mutex
+	pluginContexts map[int64]backend.PluginContext
+}
+
+func newPrewarmScheduler(ds *AwsAthenaDatasource) *prewarmScheduler {
+	return &prewarmScheduler{
+		ds:             ds,
+		pluginContexts: make(map[int64]backend.PluginContext),
+	}
+}
+
+func (s *prewarmScheduler) register(pluginContext backend.PluginContext) {
+	if s == nil || pluginContext.DataSourceInstanceSettings == nil {
+		return
+	}
+	// requests from Grafana backend don't have user, keep it unset for background queries
+	pluginContext.User = nil
+	s.lock.Lock()
+	s.pluginContexts[pluginContext.DataSourceInstanceSettings.ID] = pluginContext
+	s.lock.Unlock()
+}
+
+// registerHandler registers the datasource of the resource call, e.g. opening the query editor after the plugin restarts.
+func (s *prewarmScheduler) registerHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.register(httpadapter.PluginConfigFromContext(req.Context()))
+		next.ServeHTTP(rw, req)
+	})
+}
+
+func (s *prewarmScheduler) run() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		go s.runScheduled(next)
+	}
+}
+
+// runScheduled runs the prewarm queries scheduled at the time, and waits for them.
+func (s *prewarmScheduler) runScheduled(now time.Time) {
+	s.lock.Lock()
+	pluginContexts := make([]backend.PluginContext, 0, len(s.pluginContexts))
+	for _, pc := range s.pluginContexts {
+		pluginContexts = append(pluginContexts, pc)
+	}
+	s.lock.Unlock()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, pluginContext := range pluginContexts {
+		dsInfo, err := s.ds.getDsInfo(pluginContext, "default")
+		if err != nil {
+			backend.Logger.Warn("Prewarm Settings Warning", "warn", err.Error())
+			continue
+		}
+		for _, pq := range dsInfo.PrewarmQueries {
+			schedule, err := parseCronSchedule(pq.Schedule)
+			if err != nil {
+				backend.Logger.Warn("Prewarm Schedule Warning", "warn", err.Error(), "schedule", pq.Schedule)
+				continue
+			}
+			if !schedule.match(now) {
+				continue
+			}
+			wg.Add(1)
+			go func(pluginContext backend.PluginContext, pq PrewarmQuery) {
+				defer wg.Done()
+				s.prewarm(pluginContext, pq, now)
+			}(pluginContext, pq)
+		}
+	}
+}
+
+func (s *prewarmScheduler) prewarm(pluginContext backend.PluginContext, pq PrewarmQuery, now time.Time) {
+	r := time.Duration(pq.Range)
+	if r == 0 {
+		r = time.Hour
+	}
+	results, err := s.ds.warmCache(context.Background(), pluginContext, now.Add(-r), now, []json.RawMessage{pq.Query})
+	if err != nil {
+		backend.Logger.Warn("Prewarm Query Warning", "warn", err.Error(), "datasource", pluginContext.DataSourceInstanceSettings.ID)
+		return
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			backend.Logger.Warn("Prewarm Query Warning", "warn", result.Error, "datasource", pluginContext.DataSourceInstanceSettings.ID, "refId", result.RefId)
+		}
+	}
+}
+
+// cronSchedule is a standard 5 fields (minute, hour, day of month, month, day of week) cron schedule.
+// As the standard cron, the day matches either of the day of month and the day of week when both are restricted.
+type cronSchedule struct {
+	minute     map[int]bool
+	hour       map[int]bool
+	dayOfMonth map[int]bool
+	month      map[int]bool
+	dayOfWeek  map[int]bool
+	// the day fields start with "*"
+	anyDayOfMonth bool
+	anyDayOfWeek  bool
+}
+
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule should have 5 fields: %s", spec)
+	}
+	// 7 of the day of week is Sunday as well as 0
+	bounds := [][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	sets := make([]map[int]bool, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+	if sets[4][7] {
+		sets[4][0] = true
+	}
+	return &cronSchedule{
+		minute:        sets[0],
+		hour:          sets[1],
+		dayOfMonth:    sets[2],
+		month:         sets[3],
+		dayOfWeek:     sets[4],
+		anyDayOfMonth: strings.HasPrefix(fields[2], "*"),
+		anyDayOfWeek:  strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step, hasStep := 1, false
+		if i := strings.Index(part, "/"); i != -1 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid cron step: %s", part)
+			}
+			step, hasStep = s, true
+			part = part[:i]
+		}
+		start, end := min, max
+		if part != "*" {
+			if i := strings.Index(part, "-"); i != -1 {
+				s, err := strconv.Atoi(part[:i])
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron range: %s", part)
+				}
+				e, err := strconv.Atoi(part[i+1:])
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron range: %s", part)
+				}
+				start, end = s, e
+			} else {
+				v, err := strconv.Atoi(part)
+				if err != nil {
+					return nil, fmt.Errorf("invalid cron value: %s", part)
+				}
+				start, end = v, v
+				if hasStep {
+					// "N/step" is from N to the max
+					end = max
+				}
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("cron value out of range: %s", field)
+		}
+		for v := start; v <= end; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) match(t time.Time) bool {
+	day := s.dayOfMonth[t.Day()] && s.dayOfWeek[int(t.Weekday())]
+	if !s.anyDayOfMonth && !s.anyDayOfWeek {
+		day = s.dayOfMonth[t.Day()] || s.dayOfWeek[int(t.Weekday())]
+	}
+	return s.minute[t.Minute()] &&
+		s.hour[t.Hour()] &&
+		day &&
+		s.month[int(t.Month())]
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+func TestCronSchedule(t *testing.T) {
+	t.Run("weekday morning", func(t *testing.T) {
+		s, err := parseCronSchedule("45 8 * * 1-5")
+		assert.Equal(t, nil, err)
+		// 2020-06-08 is Monday
+		assert.Equal(t, true, s.match(time.Date(2020, 6, 8, 8, 45, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 8, 8, 46, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 7, 8, 45, 0, 0, time.UTC)))
+	})
+
+	t.Run("steps and lists", func(t *testing.T) {
+		s, err := parseCronSchedule("*/15 0,12 1 * *")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, s.match(time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 1, 12, 31, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 2, 12, 30, 0, 0, time.UTC)))
+	})
+
+	t.Run("steps on ranges", func(t *testing.T) {
+		s, err := parseCronSchedule("1-30/5 10/6 * * *")
+		assert.Equal(t, nil, err)
+		for minute, expected := range map[int]bool{1: true, 6: true, 26: true, 0: false, 5: false, 31: false, 36: false} {
+			assert.Equal(t, expected, s.match(time.Date(2020, 6, 1, 10, minute, 0, 0, time.UTC)), minute)
+		}
+		// 10/6 is 10, 16 and 22
+		assert.Equal(t, true, s.match(time.Date(2020, 6, 1, 22, 1, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 1, 4, 1, 0, 0, time.UTC)))
+	})
+
+	t.Run("day of month or day of week", func(t *testing.T) {
+		// the 1st and 15th of the month, and every Monday
+		s, err := parseCronSchedule("0 9 1,15 * 1")
+		assert.Equal(t, nil, err)
+		// 2020-06-01 and 2020-06-08 are Monday, 2020-06-15 is Monday, 2020-07-01 is Wednesday
+		assert.Equal(t, true, s.match(time.Date(2020, 6, 8, 9, 0, 0, 0, time.UTC)))
+		assert.Equal(t, true, s.match(time.Date(2020, 7, 1, 9, 0, 0, 0, time.UTC)))
+		assert.Equal(t, false, s.match(time.Date(2020, 6, 9, 9, 0, 0, 0, time.UTC)))
+
+		// restricted by the day of week only
+		s, err = parseCronSchedule("0 9 */1 * 1")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, false, s.match(time.Date(2020, 7, 1, 9, 0, 0, 0, time.UTC)))
+
+		// 7 is Sunday, 2020-06-07 is Sunday
+		s, err = parseCronSchedule("0 9 * * 7")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, true, s.match(time.Date(2020, 6, 7, 9, 0, 0, 0, time.UTC)))
+	})
+
+	t.Run("invalid schedule", func(t *testing.T) {
+		_, err := parseCronSchedule("* * *")
+		assert.Assert(t, err != nil)
+		_, err = parseCronSchedule("60 * * * *")
+		assert.Assert(t, err != nil)
+		_, err = parseCronSchedule("0 9 * * 8")
+		assert.Assert(t, err != nil)
+		_, err = parseCronSchedule("0 9 * * MON")
+		assert.Assert(t, err != nil)
+	})
+}
+
+func TestPrewarm(t *testing.T) {
+	fake, server := newFakeAthenaServer(t)
+	defer server.Close()
+
+	query := `{"refId":"A","region":"default","workgroup":"primary","queryString":"SELECT host FROM logs WHERE $__timeFilter(ts)","cacheDuration":"1h","timeAlignment":"1h","format":"table"}`
+	pluginContext := backend.PluginContext{
+		OrgID: 1,
+		DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+			ID:       100,
+			Name:     "Athena",
+			JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `","prewarmQueries":[{"schedule":"45 8 * * 1-5","range":"24h","query":` + query + `}]}`),
+			DecryptedSecureJSONData: map[string]string{
+				"accessKey": "AKID",
+				"secretKey": "secret",
+			},
+		},
+	}
+	ds := newTestDataSource()
+
+	// the datasource is registered by the resource call
+	handler := httpadapter.New(ds.prewarm.registerHandler(http.NotFoundHandler()))
+	err := handler.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: pluginContext,
+		Path:          "regions",
+		Method:        http.MethodGet,
+		URL:           "regions",
+	}, resourceResponseFunc(func(*backend.CallResourceResponse) error { return nil }))
+	assert.NilError(t, err)
+	assert.Equal(t, 1, len(ds.prewarm.pluginContexts))
+
+	// 2020-06-08 is Monday
+	scheduled := time.Date(2020, 6, 8, 8, 45, 0, 0, time.UTC)
+	ds.prewarm.runScheduled(scheduled.Add(-time.Minute))
+	assert.Equal(t, 0, fake.count("StartQueryExecution"))
+	ds.prewarm.runScheduled(scheduled)
+	assert.Equal(t, 1, fake.count("StartQueryExecution"))
+	assert.Equal(t, 1, fake.count("GetQueryResults"))
+
+	// the dashboard opened later in the aligned time range hits the warmed cache
+	opened := scheduled.Add(7 * time.Minute)
+	resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginContext,
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: opened.Add(-24 * time.Hour), To: opened},
+			Interval:  2 * time.Minute,
+			JSON:      []byte(query),
+		}},
+	})
+	assert.NilError(t, err)
+	assert.NilError(t, resp.Responses["A"].Error)
+	assert.Equal(t, 1, len(resp.Responses["A"].Frames))
+	assert.Equal(t, 1, fake.count("StartQueryExecution"))
+	assert.Equal(t, 1, fake.count("GetQueryResults"))
+
+	// the next aligned time range runs the query
+	opened = scheduled.Add(20 * time.Minute)
+	resp, err = ds.QueryData(context.Background(), &backend.QueryDataRequest{
+		PluginContext: pluginContext,
+		Queries: []backend.DataQuery{{
+			RefID:     "A",
+			TimeRange: backend.TimeRange{From: opened.Add(-24 * time.Hour), To: opened},
+			Interval:  2 * time.Minute,
+			JSON:      []byte(query),
+		}},
+	})
+	assert.NilError(t, err)
+	assert.NilError(t, resp.Responses["A"].Error)
+	assert.Equal(t, 2, fake.count("StartQueryExecution"))
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"math"
+	"net/url"
 	"strconv"
 	"time"
 
@@ -10,36 +11,101 @@ import (
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/athena"
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
-	"github.com/patrickmn/go-cache"
-	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/net/context"
 )
 
 type AwsAthenaQuery struct {
 	client                *athena.Athena
-	cache                 *cache.Cache
+	cache                 *queryCache
 	metrics               *AwsAthenaMetrics
+	dsInfo                *DatasourceInfo
+	warnings              []string
+	budget                *scanBudget
+	audit                 *auditLogger
+	orgID                 int64
+	user                  string
 	datasourceID          int64
 	waitQueryExecutionIds []*string
+	waitCount             int
+	progress              func(executions []*athena.QueryExecution)
+	interval              time.Duration
 	RefId                 string
 	Region                string
+	AssumeRoleArn         string
 	Inputs                []athena.GetQueryResultsInput
 	TimestampColumn       string
 	ValueColumn           string
 	LegendFormat          string
+	Format                string
+	MessageColumn         string
+	LevelColumn           string
+	TimeEndColumn         string
+	TitleColumn           string
+	TextColumn            string
+	TagsColumn            string
 	TimeFormat            string
 	MaxRows               string
 	CacheDuration         Duration
+	TimeAlignment         Duration
 	WorkGroup             string
 	QueryString           string
+	Variables             map[string][]string
 	OutputLocation        string
+	DashboardId           int64
+	PanelId               int64
 	From                  time.Time
 	To                    time.Time
 }
 
-func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext backend.PluginContext) (*athena.GetQueryResultsOutput, error) {
-	var err error
+// expandQueryString expands the macros in the query string, and rewrites the query for the output format.
+func (query *AwsAthenaQuery) expandQueryString() error {
+	if query.QueryString == "" {
+		return nil
+	}
+	// the query can be aligned coarser than the interval, to share the cache with the pre-warmed query
+	alignment := query.interval
+	if time.Duration(query.TimeAlignment) > alignment {
+		alignment = time.Duration(query.TimeAlignment)
+	}
+	from, to := truncateTimeRange(query.From, query.To, alignment)
+	queryString, err := expandMacros(query.QueryString, from, to, query.Variables)
+	if err != nil {
+		return err
+	}
+	if query.Format == FORMAT_LOGS_VOLUME {
+		queryString, err = logsVolumeQuery(queryString, query.TimestampColumn, query.LevelColumn, logsVolumeInterval(query.interval, query.From, query.To))
+		if err != nil {
+			return err
+		}
+		query.TimestampColumn = "time"
+		query.ValueColumn = "count"
+		if query.MaxRows == "" {
+			query.MaxRows = strconv.Itoa(LOGS_VOLUME_DEFAULT_MAX_ROWS)
+		}
+		if query.LevelColumn != "" {
+			query.LegendFormat = "{{level}}"
+		}
+	}
+	query.QueryString = queryString
+	return nil
+}
+
+func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext backend.PluginContext) (_ *athena.GetQueryResultsOutput, err error) {
+	ctx, span := startSpan(ctx, "getQueryResults",
+		attribute.String("refId", query.RefId),
+		attribute.String("region", query.Region),
+		attribute.String("workgroup", query.WorkGroup),
+	)
+	start := time.Now()
+	defer func() {
+		query.metrics.queryDuration.WithLabelValues(query.Region, query.WorkGroup).Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
 
+	if err := query.getCredentials(ctx); err != nil {
+		return nil, err
+	}
 	if query.QueryString == "" {
 		dedupe := true // TODO: add query option?
 		if dedupe {
@@ -59,6 +125,9 @@ func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext
 				}
 				allQueryExecution = append(allQueryExecution, bo.QueryExecutions...)
 			}
+			for _, e := range allQueryExecution {
+				query.completeExecution(e)
+			}
 
 			dupCheck := make(map[string]bool)
 			query.Inputs = make([]athena.GetQueryResultsInput, 0)
@@ -73,15 +142,7 @@ func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext
 			}
 		}
 	} else {
-		workgroup, err := query.getWorkgroup(ctx, pluginContext, query.Region, query.WorkGroup)
-		if err != nil {
-			return nil, err
-		}
-		if workgroup.WorkGroup.Configuration.BytesScannedCutoffPerQuery == nil {
-			return nil, fmt.Errorf("should set scan data limit")
-		}
-
-		queryExecutionID, err := query.startQueryExecution(ctx)
+		queryExecutionID, err := query.startQuery(ctx, pluginContext)
 		if err != nil {
 			return nil, err
 		}
@@ -116,27 +177,17 @@ func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext
 	for _, input := range query.Inputs {
 		var resp *athena.GetQueryResultsOutput
 
-		cacheKey := "QueryResults/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/" + query.Region + "/" + *input.QueryExecutionId + "/" + query.MaxRows
-		if item, _, found := query.cache.GetWithExpiration(cacheKey); found && query.CacheDuration > 0 {
+		cacheKey := "QueryResults/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/" + query.cacheScope() + "/" + *input.QueryExecutionId + "/" + query.MaxRows
+		item, _, found := query.cache.GetWithExpiration(cacheKey)
+		if query.CacheDuration > 0 {
+			query.observeCache("QueryResults", found)
+		}
+		if found && query.CacheDuration > 0 {
 			if r, ok := item.(*athena.GetQueryResultsOutput); ok {
 				resp = r
 			}
 		} else {
-			err := query.client.GetQueryResultsPagesWithContext(ctx, &input,
-				func(page *athena.GetQueryResultsOutput, lastPage bool) bool {
-					query.metrics.queriesTotal.With(prometheus.Labels{"region": query.Region}).Inc()
-					if resp == nil {
-						resp = page
-					} else {
-						resp.ResultSet.Rows = append(resp.ResultSet.Rows, page.ResultSet.Rows...)
-					}
-					// result include extra header row, +1 here
-					if maxRows != -1 && int64(len(resp.ResultSet.Rows)) > maxRows+1 {
-						resp.ResultSet.Rows = resp.ResultSet.Rows[0 : maxRows+1]
-						return false
-					}
-					return !lastPage
-				})
+			resp, err = query.fetchQueryResults(ctx, input, maxRows)
 			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == athena.ErrCodeInvalidRequestException {
 				backend.Logger.Warn("Get Query Results Warning", "warn", aerr.Message())
 			} else if err != nil {
@@ -155,13 +206,71 @@ func (query *AwsAthenaQuery) getQueryResults(ctx context.Context, pluginContext
 		result.ResultSet.ResultSetMetadata = resp.ResultSet.ResultSetMetadata
 		result.ResultSet.Rows = append(result.ResultSet.Rows, resp.ResultSet.Rows[1:]...) // trim header row
 	}
+	span.SetAttributes(attribute.Int("rows", len(result.ResultSet.Rows)))
 
 	return &result, nil
 }
 
+// startQuery checks the query string and the workgroup, and starts the query execution.
+func (query *AwsAthenaQuery) startQuery(ctx context.Context, pluginContext backend.PluginContext) (string, error) {
+	if err := checkQueryGuardrails(query.dsInfo, query.QueryString); err != nil {
+		return "", err
+	}
+
+	workgroup, err := query.getWorkgroup(ctx, pluginContext, query.Region, query.WorkGroup)
+	if err != nil {
+		return "", err
+	}
+	if err := query.checkScanLimit(workgroup); err != nil {
+		return "", err
+	}
+
+	return query.startQueryExecution(ctx)
+}
+
+func (query *AwsAthenaQuery) fetchQueryResults(ctx context.Context, input athena.GetQueryResultsInput, maxRows int64) (resp *athena.GetQueryResultsOutput, err error) {
+	ctx, span := startSpan(ctx, "fetchQueryResults", attribute.String("executionId", aws.StringValue(input.QueryExecutionId)))
+	pages := 0
+	defer func() {
+		span.SetAttributes(attribute.Int("pages", pages))
+		if resp != nil {
+			span.SetAttributes(attribute.Int("rows", len(resp.ResultSet.Rows)))
+		}
+		endSpan(span, err)
+	}()
+
+	err = query.client.GetQueryResultsPagesWithContext(ctx, &input,
+		func(page *athena.GetQueryResultsOutput, lastPage bool) bool {
+			pages++
+			query.metrics.resultPagesTotal.WithLabelValues(query.Region, query.WorkGroup).Inc()
+			if resp == nil {
+				resp = page
+			} else {
+				resp.ResultSet.Rows = append(resp.ResultSet.Rows, page.ResultSet.Rows...)
+			}
+			// result include extra header row, +1 here
+			if maxRows != -1 && int64(len(resp.ResultSet.Rows)) > maxRows+1 {
+				resp.ResultSet.Rows = resp.ResultSet.Rows[0 : maxRows+1]
+				return false
+			}
+			return !lastPage
+		})
+	return resp, err
+}
+
+// cacheScope returns the region part of the cache key, the per query role is appended to separate the cache by account.
+func (query *AwsAthenaQuery) cacheScope() string {
+	if query.AssumeRoleArn == "" {
+		return query.Region
+	}
+	return query.Region + "@" + url.PathEscape(query.AssumeRoleArn)
+}
+
 func (query *AwsAthenaQuery) getWorkgroup(ctx context.Context, pluginContext backend.PluginContext, region string, workGroup string) (*athena.GetWorkGroupOutput, error) {
-	WorkgroupCacheKey := "Workgroup/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/" + region + "/" + workGroup
-	if item, _, found := query.cache.GetWithExpiration(WorkgroupCacheKey); found {
+	WorkgroupCacheKey := "Workgroup/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/" + query.cacheScope() + "/" + workGroup
+	item, _, found := query.cache.GetWithExpiration(WorkgroupCacheKey)
+	query.observeCache("Workgroup", found)
+	if found {
 		if workgroup, ok := item.(*athena.GetWorkGroupOutput); ok {
 			return workgroup, nil
 		}
@@ -175,57 +284,242 @@ func (query *AwsAthenaQuery) getWorkgroup(ctx context.Context, pluginContext bac
 	return workgroup, nil
 }
 
-func (query *AwsAthenaQuery) startQueryExecution(ctx context.Context) (string, error) {
+const (
+	SCAN_LIMIT_POLICY_REQUIRE = "require"
+	SCAN_LIMIT_POLICY_MAX     = "max"
+	SCAN_LIMIT_POLICY_WARN    = "warn"
+)
+
+// checkScanLimit checks the scan data limit of the workgroup by the scan limit policy of the datasource.
+// With the warn policy, the violation is added to the query warnings instead of failing the query.
+func (query *AwsAthenaQuery) checkScanLimit(workgroup *athena.GetWorkGroupOutput) error {
+	var cutoff *int64
+	if workgroup.WorkGroup.Configuration != nil {
+		cutoff = workgroup.WorkGroup.Configuration.BytesScannedCutoffPerQuery
+	}
+
+	policy := query.dsInfo.ScanLimitPolicy
+	if policy == "" {
+		policy = SCAN_LIMIT_POLICY_REQUIRE
+	}
+	max := query.dsInfo.MaxBytesScannedCutoffPerQuery
+	if policy == SCAN_LIMIT_POLICY_REQUIRE {
+		// the maximum is checked only by max and warn policy
+		max = 0
+	} else if policy == SCAN_LIMIT_POLICY_MAX && max <= 0 {
+		return fmt.Errorf("max scan limit policy requires maxBytesScannedCutoffPerQuery in the datasource settings")
+	}
+
+	var violation string
+	if cutoff == nil {
+		violation = "should set scan data limit"
+	} else if max > 0 && *cutoff > max {
+		violation = fmt.Sprintf("scan data limit should be %d bytes or less", max)
+	}
+	if violation == "" {
+		return nil
+	}
+	violation = fmt.Sprintf("%s: %s", violation, describeWorkgroup(workgroup.WorkGroup))
+
+	switch policy {
+	case SCAN_LIMIT_POLICY_REQUIRE, SCAN_LIMIT_POLICY_MAX:
+		return fmt.Errorf("%s", violation)
+	case SCAN_LIMIT_POLICY_WARN:
+		backend.Logger.Warn("Scan Limit Warning", "warn", violation, "datasource", query.datasourceID)
+		query.warnings = append(query.warnings, violation)
+		return nil
+	default:
+		return fmt.Errorf("unknown scan limit policy: %s", policy)
+	}
+}
+
+func describeWorkgroup(wg *athena.WorkGroup) string {
+	cutoff := "none"
+	enforce := false
+	if wg.Configuration != nil {
+		if wg.Configuration.BytesScannedCutoffPerQuery != nil {
+			cutoff = fmt.Sprintf("%d bytes", *wg.Configuration.BytesScannedCutoffPerQuery)
+		}
+		enforce = aws.BoolValue(wg.Configuration.EnforceWorkGroupConfiguration)
+	}
+	return fmt.Sprintf("workgroup %s (state: %s, bytes scanned cutoff per query: %s, enforce workgroup configuration: %t)",
+		aws.StringValue(wg.Name), aws.StringValue(wg.State), cutoff, enforce)
+}
+
+// getCredentials retrieves the credentials before the first API call of the query, to trace the time for credentials separately.
+// It does nothing when the credentials are already retrieved.
+func (query *AwsAthenaQuery) getCredentials(ctx context.Context) (err error) {
+	creds := query.client.Config.Credentials
+	if creds == nil || !creds.IsExpired() {
+		return nil
+	}
+	_, span := startSpan(ctx, "credentials", attribute.String("region", query.Region), attribute.String("assumeRoleArn", query.AssumeRoleArn))
+	defer func() {
+		endSpan(span, err)
+	}()
+	_, err = creds.Get()
+	return err
+}
+
+func (query *AwsAthenaQuery) startQueryExecution(ctx context.Context) (_ string, err error) {
+	ctx, span := startSpan(ctx, "startQueryExecution", attribute.String("queryHash", queryHash(query.QueryString)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	if err := query.getCredentials(ctx); err != nil {
+		return "", err
+	}
+
 	// cache instant query result by query string
 	var queryExecutionID string
-	cacheKey := "StartQueryExecution/" + strconv.FormatInt(query.datasourceID, 10) + "/" + query.Region + "/" + query.QueryString + "/" + query.MaxRows
-	if item, _, found := query.cache.GetWithExpiration(cacheKey); found && query.CacheDuration > 0 {
+	cacheKey := "StartQueryExecution/" + strconv.FormatInt(query.datasourceID, 10) + "/" + query.cacheScope() + "/" + query.QueryString + "/" + query.MaxRows
+	item, _, found := query.cache.GetWithExpiration(cacheKey)
+	cached := found && query.CacheDuration > 0
+	if query.CacheDuration > 0 {
+		query.observeCache("StartQueryExecution", found)
+	}
+	if err := query.checkBudget(cached); err != nil {
+		return "", err
+	}
+	span.SetAttributes(attribute.Bool("cached", cached))
+	if cached {
 		if id, ok := item.(string); ok {
 			queryExecutionID = id
 		}
+		query.audit.write(query.dsInfo, query.auditRecord(AUDIT_EVENT_CACHE_HIT, query.QueryString, queryExecutionID))
+		// the cached query execution may still be running after the previous request stopped waiting for it
+		if query.budget != nil && query.budget.isPending(queryExecutionID) {
+			query.waitQueryExecutionIds = append(query.waitQueryExecutionIds, &queryExecutionID)
+		}
 	} else {
+		queryString := query.QueryString
+		if query.dsInfo.AttributionComment {
+			queryString = query.attributionComment() + queryString
+			// check the query string which is actually posted
+			if err := checkQueryGuardrails(query.dsInfo, queryString); err != nil {
+				return "", err
+			}
+		}
 		si := &athena.StartQueryExecutionInput{
-			QueryString: aws.String(query.QueryString),
+			QueryString: aws.String(queryString),
 			WorkGroup:   aws.String(query.WorkGroup),
-			ResultConfiguration: &athena.ResultConfiguration{
-				OutputLocation: aws.String(query.OutputLocation),
-			},
+		}
+		// the queries run by the backend don't have the output location set by the frontend, fallback to the datasource setting.
+		// the result location of the workgroup is used when both are not set
+		outputLocation := query.OutputLocation
+		if outputLocation == "" && query.dsInfo != nil {
+			outputLocation = query.dsInfo.OutputLocation
+		}
+		if outputLocation != "" {
+			si.ResultConfiguration = &athena.ResultConfiguration{
+				OutputLocation: aws.String(outputLocation),
+			}
 		}
 		so, err := query.client.StartQueryExecutionWithContext(ctx, si)
 		if err != nil {
+			record := query.auditRecord(AUDIT_EVENT_START_FAILED, query.QueryString, "")
+			record.Error = err.Error()
+			query.audit.write(query.dsInfo, record)
+			errorCode := "UNKNOWN"
+			if aerr, ok := err.(awserr.Error); ok {
+				errorCode = aerr.Code()
+			}
+			query.metrics.executionFailuresTotal.WithLabelValues(query.Region, query.WorkGroup, "START_FAILED", errorCode).Inc()
 			return "", err
 		}
+		query.metrics.executionsStartedTotal.WithLabelValues(query.Region, query.WorkGroup).Inc()
 		queryExecutionID = *so.QueryExecutionId
+		if query.budget != nil {
+			query.budget.track(queryExecutionID, query.datasourceID, query.user, query.client)
+		}
 		if query.CacheDuration > 0 {
 			query.cache.Set(cacheKey, queryExecutionID, time.Duration(query.CacheDuration)*time.Second)
 		}
 		query.waitQueryExecutionIds = append(query.waitQueryExecutionIds, &queryExecutionID)
 	}
+	span.SetAttributes(attribute.String("executionId", queryExecutionID))
 	return queryExecutionID, nil
 }
 
-func (query *AwsAthenaQuery) waitForQueryCompleted(ctx context.Context, waitQueryExecutionIds []*string) error {
-	for i := 0; i < QUERY_WAIT_COUNT; i++ {
+func (query *AwsAthenaQuery) waitForQueryCompleted(ctx context.Context, waitQueryExecutionIds []*string) (err error) {
+	ctx, span := startSpan(ctx, "waitForQueryCompleted", attribute.Array("executionIds", aws.StringValueSlice(waitQueryExecutionIds)))
+	polls := 0
+	var executions []*athena.QueryExecution
+	defer func() {
+		query.auditExecutions(waitQueryExecutionIds, executions)
+		states := make([]string, 0, len(executions))
+		for _, e := range executions {
+			states = append(states, aws.StringValue(e.Status.State))
+		}
+		span.SetAttributes(attribute.Int("polls", polls), attribute.Array("states", states))
+		endSpan(span, err)
+	}()
+
+	waitCount := QUERY_WAIT_COUNT
+	if query.waitCount > 0 {
+		waitCount = query.waitCount
+	}
+	for i := 0; i < waitCount; i++ {
+		polls++
 		completeCount := 0
 		bi := &athena.BatchGetQueryExecutionInput{QueryExecutionIds: waitQueryExecutionIds}
 		bo, err := query.client.BatchGetQueryExecutionWithContext(ctx, bi)
 		if err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				query.metrics.executionTimeoutsTotal.WithLabelValues(query.Region, query.WorkGroup).Add(float64(len(waitQueryExecutionIds)))
+			}
 			return err
 		}
+		executions = bo.QueryExecutions
+		if query.progress != nil {
+			query.progress(bo.QueryExecutions)
+		}
 		for _, e := range bo.QueryExecutions {
 			// TODO: add warning for FAILED or CANCELLED
-			if !(*e.Status.State == "QUEUED" || *e.Status.State == "RUNNING") {
+			if isExecutionCompleted(e) {
 				completeCount++
+				query.completeExecution(e)
 			}
 		}
 		if len(waitQueryExecutionIds) == completeCount {
-			for _, e := range bo.QueryExecutions {
-				query.metrics.dataScannedBytesTotal.With(prometheus.Labels{"region": query.Region}).Add(float64(*e.Statistics.DataScannedInBytes))
-			}
-			break
+			return nil
 		} else {
 			time.Sleep(1 * time.Second)
 		}
 	}
+
+	for _, e := range executions {
+		if state := aws.StringValue(e.Status.State); state == athena.QueryExecutionStateQueued || state == athena.QueryExecutionStateRunning {
+			query.metrics.executionTimeoutsTotal.WithLabelValues(query.Region, query.WorkGroup).Inc()
+		}
+	}
 	return nil
 }
+
+func isExecutionCompleted(e *athena.QueryExecution) bool {
+	if e.Status == nil {
+		return false
+	}
+	state := aws.StringValue(e.Status.State)
+	return state != athena.QueryExecutionStateQueued && state != athena.QueryExecutionStateRunning
+}
+
+// completeExecution records the statistics of the completed query execution to the metrics, the cache and the budget.
+// The query execution started by the plugin is recorded only once wherever the completion is seen first,
+// it returns true when the execution is recorded.
+func (query *AwsAthenaQuery) completeExecution(e *athena.QueryExecution) bool {
+	if !isExecutionCompleted(e) {
+		return false
+	}
+	if query.budget != nil && !query.budget.complete(e) {
+		return false
+	}
+	query.observeExecution(e)
+	if e.Query != nil && e.Statistics != nil && e.Statistics.DataScannedInBytes != nil {
+		// kept for the cost estimation of the explain resource
+		scannedBytesCacheKey := "ScannedBytes/" + strconv.FormatInt(query.datasourceID, 10) + "/" + query.cacheScope() + "/" + queryHash(stripAttributionComment(*e.Query))
+		query.cache.Set(scannedBytesCacheKey, *e.Statistics.DataScannedInBytes, 24*time.Hour)
+	}
+	return true
+}
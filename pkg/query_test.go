@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"gotest.tools/assert"
+)
+
+func TestCheckScanLimit(t *testing.T) {
+	workgroup := func(cutoff *int64) *athena.GetWorkGroupOutput {
+		return &athena.GetWorkGroupOutput{WorkGroup: &athena.WorkGroup{
+			Name:          aws.String("primary"),
+			State:         aws.String("ENABLED"),
+			Configuration: &athena.WorkGroupConfiguration{BytesScannedCutoffPerQuery: cutoff},
+		}}
+	}
+
+	query := &AwsAthenaQuery{dsInfo: &DatasourceInfo{}}
+	assert.Equal(t, nil, query.checkScanLimit(workgroup(aws.Int64(1<<40))))
+	assert.Error(t, query.checkScanLimit(workgroup(nil)), "should set scan data limit: workgroup primary (state: ENABLED, bytes scanned cutoff per query: none, enforce workgroup configuration: false)")
+
+	query = &AwsAthenaQuery{dsInfo: &DatasourceInfo{ScanLimitPolicy: SCAN_LIMIT_POLICY_MAX, MaxBytesScannedCutoffPerQuery: 1000}}
+	assert.Equal(t, nil, query.checkScanLimit(workgroup(aws.Int64(1000))))
+	assert.ErrorContains(t, query.checkScanLimit(workgroup(aws.Int64(1001))), "scan data limit should be 1000 bytes or less: workgroup primary (state: ENABLED, bytes scanned cutoff per query: 1001 bytes")
+
+	query = &AwsAthenaQuery{dsInfo: &DatasourceInfo{ScanLimitPolicy: SCAN_LIMIT_POLICY_WARN, MaxBytesScannedCutoffPerQuery: 1000}}
+	assert.Equal(t, nil, query.checkScanLimit(workgroup(nil)))
+	assert.Equal(t, nil, query.checkScanLimit(workgroup(aws.Int64(1001))))
+	assert.Equal(t, 2, len(query.warnings))
+}
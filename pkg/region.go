@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"golang.org/x/net/context"
+)
+
+type regionResult struct {
+	frames []*data.Frame
+	err    error
+}
+
+// getRegions returns the regions which are enabled for the account.
+func (ds *AwsAthenaDatasource) getRegions(ctx context.Context, pluginContext backend.PluginContext) ([]string, error) {
+	regionsCacheKey := "Regions/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/us-east-1"
+	if item, _, found := ds.cache.GetWithExpiration(regionsCacheKey); found {
+		if regions, ok := item.([]string); ok {
+			return regions, nil
+		}
+	}
+
+	svc, err := ds.getEC2Client(pluginContext, "us-east-1")
+	if err != nil {
+		return nil, err
+	}
+	ro, err := svc.DescribeRegionsWithContext(ctx, &ec2.DescribeRegionsInput{})
+	if err != nil {
+		return nil, err
+	}
+	regions := make([]string, 0, len(ro.Regions))
+	for _, r := range ro.Regions {
+		regions = append(regions, *r.RegionName)
+	}
+	ds.cache.Set(regionsCacheKey, regions, time.Duration(1)*time.Hour)
+
+	return regions, nil
+}
+
+// expandRegions expands the region of the query, comma separated regions or "*" for the query regions of the datasource.
+func (ds *AwsAthenaDatasource) expandRegions(pluginContext backend.PluginContext, region string) ([]string, error) {
+	if region != "*" {
+		return splitRegions(region, nil)
+	}
+	dsInfo, err := ds.getDsInfo(pluginContext, "default")
+	if err != nil {
+		return nil, err
+	}
+	return splitRegions(region, dsInfo.QueryRegions)
+}
+
+// splitRegions splits comma separated regions, "*" is expanded to the query regions.
+// "*" isn't expanded to all regions of the account, the query would be run in the regions which don't have the tables.
+func splitRegions(region string, queryRegions []string) ([]string, error) {
+	if region == "*" {
+		if len(queryRegions) == 0 {
+			return nil, fmt.Errorf("set queryRegions of the datasource to run the query in all regions")
+		}
+		return queryRegions, nil
+	}
+	if !strings.Contains(region, ",") {
+		return []string{region}, nil
+	}
+	regions := make([]string, 0)
+	for _, r := range strings.Split(region, ",") {
+		r = strings.TrimSpace(r)
+		if r != "" {
+			regions = append(regions, r)
+		}
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no region is specified: %q", region)
+	}
+	return regions, nil
+}
+
+// mergeRegionResults merges the frames of each region with region label, failed regions are reported as notices.
+func mergeRegionResults(refId string, targets []AwsAthenaQuery, results []regionResult) backend.DataResponse {
+	frames := make([]*data.Frame, 0)
+	notices := make([]data.Notice, 0)
+	errs := make([]string, 0)
+	for i, result := range results {
+		region := targets[i].Region
+		if result.err != nil {
+			text := fmt.Sprintf("%s: %s", region, result.err.Error())
+			notices = append(notices, data.Notice{Severity: data.NoticeSeverityWarning, Text: text})
+			errs = append(errs, text)
+			continue
+		}
+		for _, frame := range result.frames {
+			for _, field := range frame.Fields {
+				if field.Type().Time() {
+					continue
+				}
+				if field.Labels == nil {
+					field.Labels = data.Labels{}
+				}
+				field.Labels["region"] = region
+			}
+		}
+		frames = append(frames, result.frames...)
+	}
+
+	if len(errs) == len(results) {
+		return backend.DataResponse{
+			Error: fmt.Errorf("%s", strings.Join(errs, ", ")),
+		}
+	}
+	if len(notices) > 0 {
+		if len(frames) == 0 {
+			frame := data.NewFrame("")
+			frame.RefID = refId
+			frames = append(frames, frame)
+		}
+		if frames[0].Meta == nil {
+			frames[0].Meta = &data.FrameMeta{}
+		}
+		frames[0].Meta.Notices = append(frames[0].Meta.Notices, notices...)
+	}
+	return backend.DataResponse{
+		Frames: frames,
+	}
+}
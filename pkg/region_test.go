@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"gotest.tools/assert"
+)
+
+func TestRegionFanout(t *testing.T) {
+	t.Run("expandRegions", func(t *testing.T) {
+		ds := &AwsAthenaDatasource{}
+		regions, err := ds.expandRegions(backend.PluginContext{}, "us-east-1, us-west-2,")
+		assert.Equal(t, nil, err)
+		assert.DeepEqual(t, []string{"us-east-1", "us-west-2"}, regions)
+
+		regions, err = ds.expandRegions(backend.PluginContext{}, "default")
+		assert.Equal(t, nil, err)
+		assert.DeepEqual(t, []string{"default"}, regions)
+	})
+
+	t.Run("splitRegions", func(t *testing.T) {
+		regions, err := splitRegions("*", []string{"us-east-1", "ap-northeast-1"})
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"us-east-1", "ap-northeast-1"}, regions)
+
+		_, err = splitRegions("*", nil)
+		assert.Error(t, err, "set queryRegions of the datasource to run the query in all regions")
+
+		_, err = splitRegions(", ", nil)
+		assert.Error(t, err, `no region is specified: ", "`)
+	})
+
+	t.Run("mergeRegionResults", func(t *testing.T) {
+		targets := []AwsAthenaQuery{{RefId: "A", Region: "us-east-1"}, {RefId: "A", Region: "us-west-2"}}
+		frame := data.NewFrame("", data.NewField("value", nil, []*float64{aws.Float64(1)}))
+		resp := mergeRegionResults("A", targets, []regionResult{
+			{frames: []*data.Frame{frame}},
+			{err: errors.New("failed")},
+		})
+		assert.Equal(t, nil, resp.Error)
+		assert.Equal(t, 1, len(resp.Frames))
+		assert.Equal(t, "us-east-1", resp.Frames[0].Fields[0].Labels["region"])
+		assert.Equal(t, "us-west-2: failed", resp.Frames[0].Meta.Notices[0].Text)
+
+		resp = mergeRegionResults("A", targets, []regionResult{
+			{err: errors.New("failed")},
+			{err: errors.New("failed")},
+		})
+		assert.Assert(t, resp.Error != nil)
+	})
+}
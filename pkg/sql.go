@@ -0,0 +1,452 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	statementTypeRead    = "read"
+	statementTypeDML     = "dml"
+	statementTypeDDL     = "ddl"
+	statementTypeUnknown = "unknown"
+)
+
+var statementTypes = map[string]string{
+	"SELECT":   statementTypeRead,
+	"WITH":     statementTypeRead,
+	"VALUES":   statementTypeRead,
+	"SHOW":     statementTypeRead,
+	"DESCRIBE": statementTypeRead,
+	"DESC":     statementTypeRead,
+	"TABLE":    statementTypeRead,
+	"INSERT":   statementTypeDML,
+	"DELETE":   statementTypeDML,
+	"UPDATE":   statementTypeDML,
+	"MERGE":    statementTypeDML,
+	"UNLOAD":   statementTypeDML,
+	"CREATE":   statementTypeDDL,
+	"DROP":     statementTypeDDL,
+	"ALTER":    statementTypeDDL,
+	"MSCK":     statementTypeDDL,
+	"VACUUM":   statementTypeDDL,
+	"OPTIMIZE": statementTypeDDL,
+}
+
+type sqlTokenKind int
+
+const (
+	sqlTokenWord sqlTokenKind = iota
+	sqlTokenQuotedIdentifier
+	sqlTokenString
+	sqlTokenSymbol
+)
+
+type sqlToken struct {
+	kind  sqlTokenKind
+	value string
+	// offsets of the token in the query
+	start int
+	end   int
+}
+
+func (t sqlToken) isKeyword(keyword string) bool {
+	return t.kind == sqlTokenWord && strings.EqualFold(t.value, keyword)
+}
+
+func (t sqlToken) isSymbol(symbol string) bool {
+	return t.kind == sqlTokenSymbol && t.value == symbol
+}
+
+// tokenizeSQL splits the query to tokens, comments are dropped.
+func tokenizeSQL(query string) ([]sqlToken, error) {
+	tokens := make([]sqlToken, 0)
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			end := strings.Index(query[i:], "\n")
+			if end == -1 {
+				i = len(query)
+			} else {
+				i += end + 1
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			end := strings.Index(query[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+		case c == '\'' || c == '"' || c == '`':
+			value, n, err := readQuoted(query[i:], c)
+			if err != nil {
+				return nil, err
+			}
+			kind := sqlTokenQuotedIdentifier
+			if c == '\'' {
+				kind = sqlTokenString
+			}
+			tokens = append(tokens, sqlToken{kind: kind, value: value, start: i, end: i + n})
+			i += n
+		case isWordChar(c):
+			j := i
+			for j < len(query) && isWordChar(query[j]) {
+				j++
+			}
+			tokens = append(tokens, sqlToken{kind: sqlTokenWord, value: query[i:j], start: i, end: j})
+			i = j
+		default:
+			tokens = append(tokens, sqlToken{kind: sqlTokenSymbol, value: string(c), start: i, end: i + 1})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+// readQuoted reads the quoted string, the doubled quote is unescaped.
+func readQuoted(s string, quote byte) (string, int, error) {
+	var sb strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != quote {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == quote {
+			sb.WriteByte(quote)
+			i++
+			continue
+		}
+		return sb.String(), i + 1, nil
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+func isWordChar(c byte) bool {
+	return c == '_' || c == '$' || c == '@' || c == ':' ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c >= 0x80
+}
+
+// classifyStatement returns the statement type and the leading keyword of the query.
+func classifyStatement(tokens []sqlToken) (string, string, error) {
+	i := 0
+	for i < len(tokens) && tokens[i].isSymbol("(") {
+		i++
+	}
+	if i >= len(tokens) || tokens[i].kind != sqlTokenWord {
+		return statementTypeUnknown, "", fmt.Errorf("query should start with a statement keyword")
+	}
+	for j, t := range tokens {
+		if t.isSymbol(";") && j != len(tokens)-1 {
+			return statementTypeUnknown, "", fmt.Errorf("multiple statements are not allowed")
+		}
+	}
+
+	keyword := strings.ToUpper(tokens[i].value)
+	if keyword == "EXPLAIN" {
+		// EXPLAIN ANALYZE runs the statement, classify the explained statement
+		j := i + 1
+		for j < len(tokens) && (tokens[j].isKeyword("ANALYZE") || tokens[j].isKeyword("VERBOSE")) {
+			j++
+		}
+		if j < len(tokens) && tokens[j].isSymbol("(") {
+			// EXPLAIN (TYPE ..., FORMAT ...)
+			for j < len(tokens) && !tokens[j].isSymbol(")") {
+				j++
+			}
+			j++
+		}
+		t, _, err := classifyStatement(tokens[j:])
+		return t, keyword, err
+	}
+	if t, ok := statementTypes[keyword]; ok {
+		return t, keyword, nil
+	}
+	return statementTypeUnknown, keyword, nil
+}
+
+// referencedTables returns the tables which appear after FROM, JOIN, INTO and TABLE, the CTE names of the leading WITH clause are excluded.
+// Unqualified table names are qualified with the default database, the catalog of the fully qualified names is kept.
+// The relation which can't be parsed is an error, not to pass the table which isn't checked.
+func referencedTables(tokens []sqlToken, defaultDatabase string) ([]string, error) {
+	cteNames := leadingCTENames(tokens)
+	tables := make([]string, 0)
+	seen := make(map[string]bool)
+	add := func(name []string) {
+		if len(name) == 1 && cteNames[strings.ToLower(name[0])] {
+			return
+		}
+		if len(name) == 1 {
+			name = []string{defaultDatabase, name[0]}
+		}
+		table := strings.ToLower(strings.Join(name, "."))
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+
+	// the words before the open parentheses, to skip FROM in the function arguments such as EXTRACT(hour FROM ts)
+	parens := make([]string, 0)
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.isSymbol("("):
+			word := ""
+			if i > 0 && tokens[i-1].kind == sqlTokenWord {
+				word = strings.ToUpper(tokens[i-1].value)
+			}
+			parens = append(parens, word)
+		case t.isSymbol(")"):
+			if len(parens) > 0 {
+				parens = parens[:len(parens)-1]
+			}
+		case t.isKeyword("INTO") || t.isKeyword("TABLE"):
+			if name, n := readQualifiedName(tokens[i+1:]); n > 0 {
+				add(name)
+			}
+		case t.isKeyword("FROM"):
+			if (len(parens) > 0 && functionsWithFrom[parens[len(parens)-1]]) || (i > 0 && tokens[i-1].isKeyword("DISTINCT")) {
+				continue
+			}
+			if err := readRelationList(tokens, i+1, add); err != nil {
+				return nil, err
+			}
+		case t.isKeyword("JOIN"):
+			if _, err := readRelation(tokens, i+1, add); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tables, nil
+}
+
+// functions which take FROM in the arguments
+var functionsWithFrom = map[string]bool{
+	"EXTRACT": true, "SUBSTRING": true, "TRIM": true, "POSITION": true, "OVERLAY": true,
+}
+
+// leadingCTENames returns the CTE names of the WITH clause at the start of the query.
+func leadingCTENames(tokens []sqlToken) map[string]bool {
+	names := make(map[string]bool)
+	i := 0
+	if i < len(tokens) && tokens[i].isKeyword("EXPLAIN") {
+		i++
+		for i < len(tokens) && (tokens[i].isKeyword("ANALYZE") || tokens[i].isKeyword("VERBOSE")) {
+			i++
+		}
+		if i < len(tokens) && tokens[i].isSymbol("(") {
+			i = matchingParen(tokens, i) + 1
+		}
+	}
+	for i < len(tokens) && tokens[i].isSymbol("(") {
+		i++
+	}
+	if i >= len(tokens) || !tokens[i].isKeyword("WITH") {
+		return names
+	}
+	i++
+	if i < len(tokens) && tokens[i].isKeyword("RECURSIVE") {
+		i++
+	}
+	// name [(columns)] AS (query) [, ...]
+	for i < len(tokens) && isIdentifier(tokens[i]) {
+		name := tokens[i].value
+		i++
+		if i < len(tokens) && tokens[i].isSymbol("(") {
+			if i = matchingParen(tokens, i); i == -1 {
+				break
+			}
+			i++
+		}
+		if !(i+1 < len(tokens) && tokens[i].isKeyword("AS") && tokens[i+1].isSymbol("(")) {
+			break
+		}
+		if i = matchingParen(tokens, i+1); i == -1 {
+			break
+		}
+		names[strings.ToLower(name)] = true
+		i++
+		if !(i < len(tokens) && tokens[i].isSymbol(",")) {
+			break
+		}
+		i++
+	}
+	return names
+}
+
+// keywords which end the relation list of FROM
+var relationListEndKeywords = map[string]bool{
+	"WHERE": true, "GROUP": true, "HAVING": true, "ORDER": true, "LIMIT": true, "OFFSET": true, "FETCH": true,
+	"UNION": true, "INTERSECT": true, "EXCEPT": true, "WINDOW": true,
+}
+
+// readRelationList reads the comma separated relations from i, until the end of the FROM clause.
+// The joined relations are read by the caller, the relation list is continued after them.
+func readRelationList(tokens []sqlToken, i int, add func([]string)) error {
+	i, err := readRelation(tokens, i, add)
+	if err != nil {
+		return err
+	}
+	for depth := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		switch {
+		case t.isSymbol("("):
+			depth++
+		case t.isSymbol(")"):
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		case depth > 0:
+		case t.isSymbol(";") || (t.kind == sqlTokenWord && relationListEndKeywords[strings.ToUpper(t.value)]):
+			return nil
+		case t.isSymbol(","):
+			if i, err = readRelation(tokens, i+1, add); err != nil {
+				return err
+			}
+			i--
+		}
+	}
+	return nil
+}
+
+// readRelation reads the relation at i, and returns the position after it.
+// The tables in the subquery are read by the caller, the parenthesized relation is read here.
+func readRelation(tokens []sqlToken, i int, add func([]string)) (int, error) {
+	if i < len(tokens) && tokens[i].isKeyword("LATERAL") {
+		i++
+	}
+	if i >= len(tokens) {
+		return i, fmt.Errorf("relation is missing")
+	}
+	if tokens[i].isSymbol("(") {
+		end := matchingParen(tokens, i)
+		if end == -1 {
+			return i, fmt.Errorf("unbalanced parentheses")
+		}
+		j := i + 1
+		for j < end && tokens[j].isSymbol("(") {
+			j++
+		}
+		if !(j < end && (tokens[j].isKeyword("SELECT") || tokens[j].isKeyword("WITH") || tokens[j].isKeyword("VALUES") || tokens[j].isKeyword("TABLE"))) {
+			if err := readRelationList(tokens, i+1, add); err != nil {
+				return i, err
+			}
+		}
+		return end + 1, nil
+	}
+	name, n := readQualifiedName(tokens[i:])
+	if n == 0 {
+		return i, fmt.Errorf("unexpected %s in relation", tokens[i].value)
+	}
+	i += n
+	if i < len(tokens) && tokens[i].isSymbol("(") {
+		// table function, only UNNEST is allowed as it doesn't read the tables
+		if !(len(name) == 1 && strings.EqualFold(name[0], "UNNEST")) {
+			return i, fmt.Errorf("table function %s is not allowed", strings.Join(name, "."))
+		}
+		end := matchingParen(tokens, i)
+		if end == -1 {
+			return i, fmt.Errorf("unbalanced parentheses")
+		}
+		return end + 1, nil
+	}
+	add(name)
+	return i, nil
+}
+
+// matchingParen returns the position of the parenthesis which closes the one at i, or -1.
+func matchingParen(tokens []sqlToken, i int) int {
+	depth := 0
+	for ; i < len(tokens); i++ {
+		if tokens[i].isSymbol("(") {
+			depth++
+		} else if tokens[i].isSymbol(")") {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func readQualifiedName(tokens []sqlToken) ([]string, int) {
+	name := make([]string, 0)
+	i := 0
+	for i < len(tokens) && isIdentifier(tokens[i]) && !isClauseKeyword(tokens[i]) {
+		name = append(name, tokens[i].value)
+		i++
+		if i+1 < len(tokens) && tokens[i].isSymbol(".") {
+			i++
+			continue
+		}
+		break
+	}
+	return name, i
+}
+
+func isIdentifier(t sqlToken) bool {
+	return t.kind == sqlTokenWord || t.kind == sqlTokenQuotedIdentifier
+}
+
+var clauseKeywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "GROUP": true, "ORDER": true, "HAVING": true, "LIMIT": true,
+	"JOIN": true, "INNER": true, "LEFT": true, "RIGHT": true, "FULL": true, "CROSS": true, "OUTER": true,
+	"ON": true, "USING": true, "UNION": true, "INTERSECT": true, "EXCEPT": true, "WINDOW": true,
+	"OFFSET": true, "FETCH": true, "VALUES": true, "LATERAL": true, "TABLESAMPLE": true, "FOR": true,
+}
+
+func isClauseKeyword(t sqlToken) bool {
+	return t.kind == sqlTokenWord && clauseKeywords[strings.ToUpper(t.value)]
+}
+
+// checkQueryGuardrails rejects the query which isn't allowed by the datasource settings.
+func checkQueryGuardrails(dsInfo *DatasourceInfo, query string) error {
+	tokens, err := tokenizeSQL(query)
+	if err != nil {
+		return fmt.Errorf("failed to parse query: %s", err.Error())
+	}
+	statementType, keyword, err := classifyStatement(tokens)
+	if err != nil {
+		return fmt.Errorf("failed to parse query: %s", err.Error())
+	}
+	switch statementType {
+	case statementTypeDDL:
+		if !dsInfo.AllowDDL {
+			return fmt.Errorf("%s statement is not allowed, DDL statements are disabled in the datasource settings", keyword)
+		}
+	case statementTypeDML:
+		if !dsInfo.AllowDML {
+			return fmt.Errorf("%s statement is not allowed, DML statements are disabled in the datasource settings", keyword)
+		}
+	case statementTypeUnknown:
+		if !(dsInfo.AllowDDL && dsInfo.AllowDML) {
+			return fmt.Errorf("%s statement is not allowed, unknown statements are allowed only when both DDL and DML statements are enabled", keyword)
+		}
+	}
+
+	if len(dsInfo.AllowedTables) == 0 {
+		return nil
+	}
+	tables, err := referencedTables(tokens, "default")
+	if err != nil {
+		return fmt.Errorf("failed to parse query: %s", err.Error())
+	}
+	for _, table := range tables {
+		allowed := false
+		for _, pattern := range dsInfo.AllowedTables {
+			if ok, _ := path.Match(strings.ToLower(pattern), table); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("table %s is not allowed, allowed tables are %s", table, strings.Join(dsInfo.AllowedTables, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestQueryGuardrails(t *testing.T) {
+	t.Run("classifyStatement", func(t *testing.T) {
+		for query, expected := range map[string]string{
+			"SELECT 1": statementTypeRead,
+			"-- drop table\n/* insert */ (SELECT 'DROP')": statementTypeRead,
+			"WITH t AS (SELECT 1) SELECT * FROM t":        statementTypeRead,
+			"SHOW TABLES":                                 statementTypeRead,
+			"EXPLAIN ANALYZE SELECT 1":                    statementTypeRead,
+			"EXPLAIN (TYPE DISTRIBUTED) DROP TABLE t":     statementTypeDDL,
+			"insert into t select 1":                      statementTypeDML,
+			"UNLOAD (SELECT 1) TO 's3://bucket/'":         statementTypeDML,
+			"CREATE TABLE t AS SELECT 1":                  statementTypeDDL,
+			"MSCK REPAIR TABLE t":                         statementTypeDDL,
+			"GRANT SELECT ON t TO u":                      statementTypeUnknown,
+		} {
+			tokens, err := tokenizeSQL(query)
+			assert.Equal(t, nil, err)
+			st, _, err := classifyStatement(tokens)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, expected, st, query)
+		}
+
+		tokens, _ := tokenizeSQL("SELECT 1; DROP TABLE t")
+		_, _, err := classifyStatement(tokens)
+		assert.ErrorContains(t, err, "multiple statements")
+	})
+
+	t.Run("referencedTables", func(t *testing.T) {
+		tokens, err := tokenizeSQL(`WITH w AS (SELECT * FROM db1.t1) SELECT * FROM w, "db2"."t2" a JOIN t3 AS b ON a.id = b.id CROSS JOIN UNNEST(a.x) WHERE a.id IN (SELECT id FROM db1.t4)`)
+		assert.Equal(t, nil, err)
+		tables, err := referencedTables(tokens, "default")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"db1.t1", "db2.t2", "default.t3", "db1.t4"}, tables)
+
+		for query, expected := range map[string][]string{
+			"SELECT * FROM (other.secret)":                                            {"other.secret"},
+			"SELECT * FROM db.t, (other.secret)":                                      {"db.t", "other.secret"},
+			"SELECT * FROM ((db.t a JOIN other.secret b ON a.id = b.id))":             {"db.t", "other.secret"},
+			"SELECT x, secret AS y FROM secret":                                       {"default.secret"},
+			"SELECT * FROM db.t a JOIN db.u b ON a.id = b.id, other.secret":           {"db.t", "other.secret", "db.u"},
+			"SELECT * FROM awsdatacatalog.db.t":                                       {"awsdatacatalog.db.t"},
+			"SELECT extract(hour FROM ts) FROM (SELECT * FROM db.t) x":                {"db.t"},
+			"WITH a (id) AS (SELECT 1), b AS (SELECT * FROM db.t) SELECT * FROM a, b": {"db.t"},
+			"SELECT * FROM db.t WHERE id IN (WITH s AS (SELECT 1) SELECT * FROM s)":   {"db.t", "default.s"},
+		} {
+			tokens, err := tokenizeSQL(query)
+			assert.NilError(t, err)
+			tables, err := referencedTables(tokens, "default")
+			assert.NilError(t, err, query)
+			assert.DeepEqual(t, expected, tables)
+		}
+
+		for query, expected := range map[string]string{
+			"SELECT * FROM TABLE(system.query(query => 'SELECT * FROM secret'))": "table function TABLE is not allowed",
+			"SELECT * FROM db.t, 'secret'":                                       "unexpected secret in relation",
+			"SELECT * FROM":                                                      "relation is missing",
+		} {
+			tokens, err := tokenizeSQL(query)
+			assert.NilError(t, err)
+			_, err = referencedTables(tokens, "default")
+			assert.Error(t, err, expected, query)
+		}
+	})
+
+	t.Run("checkQueryGuardrails", func(t *testing.T) {
+		dsInfo := &DatasourceInfo{}
+		assert.Equal(t, nil, checkQueryGuardrails(dsInfo, "SELECT * FROM db.t"))
+		assert.Error(t, checkQueryGuardrails(dsInfo, "DROP TABLE db.t"), "DROP statement is not allowed, DDL statements are disabled in the datasource settings")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "INSERT INTO db.t SELECT 1"), "DML statements are disabled")
+
+		dsInfo = &DatasourceInfo{AllowDML: true, AllowedTables: []string{"db.*", "other.logs"}}
+		assert.Equal(t, nil, checkQueryGuardrails(dsInfo, "INSERT INTO db.t SELECT * FROM other.logs"))
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM other.secret"), "table other.secret is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM t"), "table default.t is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM (other.secret)"), "table other.secret is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM db.t, (other.secret)"), "table other.secret is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT x, secret AS y FROM secret"), "table default.secret is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM awsdatacatalog.db.t"), "table awsdatacatalog.db.t is not allowed")
+		assert.ErrorContains(t, checkQueryGuardrails(dsInfo, "SELECT * FROM TABLE(db.f())"), "failed to parse query: table function TABLE is not allowed")
+		assert.Equal(t, nil, checkQueryGuardrails(dsInfo, "WITH secret AS (SELECT * FROM db.t) SELECT * FROM secret"))
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/net/context"
+)
+
+const (
+	STREAM_QUERY_PATH_PREFIX = "query/"
+	STREAM_TAIL_PATH_PREFIX  = "tail/"
+	// tail queries are re-run at this interval at the shortest
+	STREAM_TAIL_MIN_INTERVAL = 10 * time.Second
+	// tail queries re-query this duration before the last seen timestamp, to catch the late rows
+	STREAM_TAIL_DEFAULT_OVERLAP = 5 * time.Minute
+	// registered queries should be subscribed in this duration
+	STREAM_QUERY_TTL = 10 * time.Minute
+	// the stream waits the query execution longer than the query API, 1 second per poll
+	STREAM_QUERY_WAIT_COUNT = 900
+)
+
+// streamQuery is the query registered by the stream_query resource, it is run by the first subscriber of the channel.
+// With the tail interval, the query is re-run periodically and only new rows are sent.
+type streamQuery struct {
+	OrgID        int64           `json:"orgId"`
+	From         time.Time       `json:"from"`
+	To           time.Time       `json:"to"`
+	TailInterval time.Duration   `json:"tailInterval"`
+	TailOverlap  time.Duration   `json:"tailOverlap"`
+	Query        json.RawMessage `json:"query"`
+}
+
+type streamQueryRequest struct {
+	From         time.Time       `json:"from"`
+	To           time.Time       `json:"to"`
+	TailInterval Duration        `json:"tailInterval"`
+	TailOverlap  Duration        `json:"tailOverlap"`
+	Query        json.RawMessage `json:"query"`
+}
+
+func streamQueryCacheKey(datasourceID int64, id string) string {
+	return "StreamQuery/" + strconv.FormatInt(datasourceID, 10) + "/" + id
+}
+
+// handleResourceStreamQuery registers the query, and returns the channel path to subscribe.
+// The same query in the same org shares the channel, so that the query execution is started only once.
+func (ds *AwsAthenaDatasource) handleResourceStreamQuery(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodPost {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+
+	var sr streamQueryRequest
+	if err := json.NewDecoder(req.Body).Decode(&sr); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	var target AwsAthenaQuery
+	if err := json.Unmarshal(sr.Query, &target); err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	if target.QueryString == "" && len(target.Inputs) == 0 {
+		writeResult(rw, "?", nil, fmt.Errorf("queryString or inputs should be set"))
+		return
+	}
+
+	sq := streamQuery{
+		OrgID:        pluginContext.OrgID,
+		From:         sr.From,
+		To:           sr.To,
+		TailInterval: time.Duration(sr.TailInterval),
+		Query:        sr.Query,
+	}
+	if sq.TailInterval > 0 {
+		sq.TailOverlap = time.Duration(sr.TailOverlap)
+		if sq.TailOverlap <= 0 {
+			sq.TailOverlap = STREAM_TAIL_DEFAULT_OVERLAP
+		}
+	}
+	prefix := STREAM_QUERY_PATH_PREFIX
+	if sq.TailInterval > 0 {
+		if err := checkTailQuery(target, sq.TailInterval); err != nil {
+			writeResult(rw, "?", nil, err)
+			return
+		}
+		prefix = STREAM_TAIL_PATH_PREFIX
+	}
+	b, err := json.Marshal(sq)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+	id := queryHash(string(b))
+	ds.streams.Set(streamQueryCacheKey(pluginContext.DataSourceInstanceSettings.ID, id), sq, STREAM_QUERY_TTL)
+
+	writeResult(rw, "stream_query", map[string]string{"path": prefix + id}, nil)
+}
+
+func checkTailQuery(target AwsAthenaQuery, interval time.Duration) error {
+	if target.QueryString == "" {
+		return fmt.Errorf("tail requires queryString")
+	}
+	if target.TimestampColumn == "" {
+		return fmt.Errorf("tail requires timestampColumn")
+	}
+	if interval < STREAM_TAIL_MIN_INTERVAL {
+		return fmt.Errorf("tail interval should be %s or longer", STREAM_TAIL_MIN_INTERVAL)
+	}
+	return nil
+}
+
+func (ds *AwsAthenaDatasource) getStreamQuery(pluginContext backend.PluginContext, path string) (*streamQuery, bool) {
+	var id string
+	if strings.HasPrefix(path, STREAM_QUERY_PATH_PREFIX) {
+		id = strings.TrimPrefix(path, STREAM_QUERY_PATH_PREFIX)
+	} else if strings.HasPrefix(path, STREAM_TAIL_PATH_PREFIX) {
+		id = strings.TrimPrefix(path, STREAM_TAIL_PATH_PREFIX)
+	} else {
+		return nil, false
+	}
+	item, found := ds.streams.Get(streamQueryCacheKey(pluginContext.DataSourceInstanceSettings.ID, id))
+	if !found {
+		return nil, false
+	}
+	sq, ok := item.(streamQuery)
+	if !ok {
+		return nil, false
+	}
+	// the path prefix should match the registered mode
+	if (sq.TailInterval > 0) != strings.HasPrefix(path, STREAM_TAIL_PATH_PREFIX) {
+		return nil, false
+	}
+	return &sq, true
+}
+
+func (ds *AwsAthenaDatasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	backend.Logger.Debug("Received subscribe stream call", "path", req.Path)
+	sq, found := ds.getStreamQuery(req.PluginContext, req.Path)
+	if !found {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusNotFound}, nil
+	}
+	if sq.OrgID != req.PluginContext.OrgID {
+		return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusPermissionDenied}, nil
+	}
+	return &backend.SubscribeStreamResponse{Status: backend.SubscribeStreamStatusOK}, nil
+}
+
+func (ds *AwsAthenaDatasource) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{Status: backend.PublishStreamStatusPermissionDenied}, nil
+}
+
+// RunStream runs the registered query, sends the status frame on every state transition of the query executions,
+// and sends the result frames when the query executions are completed.
+func (ds *AwsAthenaDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	backend.Logger.Debug("Received run stream call", "path", req.Path)
+	ctx, span := startSpan(ctx, "RunStream", attribute.String("path", req.Path))
+	defer span.End()
+
+	sq, found := ds.getStreamQuery(req.PluginContext, req.Path)
+	if !found {
+		return fmt.Errorf("stream query not found: %s", req.Path)
+	}
+	if sq.TailInterval > 0 {
+		return ds.runTailStream(ctx, req, sq, sender)
+	}
+
+	target, err := ds.newQueryTarget(ctx, req.PluginContext, sq.Query, sq.From, sq.To)
+	if err != nil {
+		return sendStreamError(sender, target.RefId, err)
+	}
+
+	last := make(map[string]string)
+	target.waitCount = STREAM_QUERY_WAIT_COUNT
+	target.progress = func(executions []*athena.QueryExecution) {
+		changed := false
+		for _, e := range executions {
+			status := executionProgress(e)
+			if last[aws.StringValue(e.QueryExecutionId)] != status {
+				last[aws.StringValue(e.QueryExecutionId)] = status
+				changed = true
+			}
+		}
+		if !changed {
+			return
+		}
+		if err := sender.SendFrame(newStatusFrame(target.RefId, executions), data.IncludeAll); err != nil {
+			backend.Logger.Warn("Stream Warning", "warn", err.Error(), "path", req.Path)
+		}
+	}
+
+	frames, err := target.getFrames(ctx, req.PluginContext)
+	if err != nil {
+		return sendStreamError(sender, target.RefId, err)
+	}
+	for _, frame := range frames {
+		if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runTailStream re-runs the query at the tail interval until all subscribers leave.
+// The time range of the query starts the overlap before the last seen timestamp, and the rows which are not sent yet are sent,
+// so that the rows which share the last timestamp or arrive late in the overlap are sent once.
+func (ds *AwsAthenaDatasource) runTailStream(ctx context.Context, req *backend.RunStreamRequest, sq *streamQuery, sender *backend.StreamSender) error {
+	lastSeen := sq.From
+	rows := newTailRows()
+	for {
+		to := time.Now()
+		windowStart := lastSeen.Add(-sq.TailOverlap)
+		if windowStart.Before(sq.From) {
+			windowStart = sq.From
+		}
+		target, err := ds.newQueryTarget(ctx, req.PluginContext, sq.Query, windowStart, to)
+		if err == nil {
+			// each run should start the new query execution
+			target.CacheDuration = 0
+			var frames []*data.Frame
+			frames, err = target.getFrames(ctx, req.PluginContext)
+			if err == nil {
+				var latest time.Time
+				latest, err = rows.send(sender, frames, target.TimestampColumn, windowStart)
+				if latest.After(lastSeen) {
+					lastSeen = latest
+				}
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			backend.Logger.Warn("Stream Warning", "warn", err.Error(), "path", req.Path)
+			if err := sendStreamError(sender, target.RefId, err); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(sq.TailInterval):
+		}
+	}
+}
+
+// tailRows remembers the hashes of the rows sent by the tail stream in the overlap window.
+type tailRows struct {
+	seen map[string]time.Time
+}
+
+func newTailRows() *tailRows {
+	return &tailRows{seen: make(map[string]time.Time)}
+}
+
+// send sends the rows in the window which are not sent yet, and returns the latest timestamp of the rows.
+func (r *tailRows) send(sender *backend.StreamSender, frames []*data.Frame, timestampColumn string, windowStart time.Time) (time.Time, error) {
+	r.prune(windowStart)
+	var latest time.Time
+	for _, frame := range frames {
+		newFrame, newLatest, err := r.filterNewRows(frame, timestampColumn, windowStart)
+		if err != nil {
+			return latest, err
+		}
+		if newFrame.Rows() == 0 {
+			continue
+		}
+		if err := sender.SendFrame(newFrame, data.IncludeAll); err != nil {
+			return latest, err
+		}
+		if newLatest.After(latest) {
+			latest = newLatest
+		}
+	}
+	return latest, nil
+}
+
+// filterNewRows returns the rows in the window which are not sent yet, and the latest timestamp of all rows in the frame.
+func (r *tailRows) filterNewRows(frame *data.Frame, timestampColumn string, windowStart time.Time) (*data.Frame, time.Time, error) {
+	var latest time.Time
+	timestampIndex := -1
+	for i, field := range frame.Fields {
+		if field.Name == timestampColumn {
+			timestampIndex = i
+		}
+	}
+	if timestampIndex == -1 {
+		return nil, latest, fmt.Errorf("timestamp column not found: %s", timestampColumn)
+	}
+	newFrame := frame.EmptyCopy()
+	for i := 0; i < frame.Rows(); i++ {
+		v, ok := frame.Fields[timestampIndex].At(i).(*time.Time)
+		if !ok {
+			return nil, latest, fmt.Errorf("expected time input but got type %T", frame.Fields[timestampIndex].At(i))
+		}
+		if v == nil || v.Before(windowStart) {
+			continue
+		}
+		if v.After(latest) {
+			latest = *v
+		}
+		key := rowKey(frame, i)
+		if _, sent := r.seen[key]; sent {
+			continue
+		}
+		r.seen[key] = *v
+		newFrame.AppendRow(frame.RowCopy(i)...)
+	}
+	newFrame.Meta = frame.Meta
+	return newFrame, latest, nil
+}
+
+// prune forgets the rows before the window, they are not returned by the query any more.
+func (r *tailRows) prune(windowStart time.Time) {
+	for key, t := range r.seen {
+		if t.Before(windowStart) {
+			delete(r.seen, key)
+		}
+	}
+}
+
+// rowKey returns the hash of the values of the row, the frame name and labels separate the series.
+func rowKey(frame *data.Frame, i int) string {
+	values := make([]string, 0, len(frame.Fields)+1)
+	values = append(values, frame.Name)
+	for _, field := range frame.Fields {
+		v, _ := field.ConcreteAt(i)
+		values = append(values, field.Labels.String()+"="+fmt.Sprint(v))
+	}
+	return queryHash(strings.Join(values, "\x00"))
+}
+
+// newQueryTarget returns the single region query target of the query registered by the resource call.
+func (ds *AwsAthenaDatasource) newQueryTarget(ctx context.Context, pluginContext backend.PluginContext, query json.RawMessage, from time.Time, to time.Time) (AwsAthenaQuery, error) {
+	var target AwsAthenaQuery
+	if err := json.Unmarshal(query, &target); err != nil {
+		return target, err
+	}
+	target.From = from
+	target.To = to
+	if err := target.expandQueryString(); err != nil {
+		return target, err
+	}
+
+	regions, err := ds.expandRegions(pluginContext, target.Region)
+	if err != nil {
+		return target, err
+	}
+	if len(regions) != 1 {
+		return target, fmt.Errorf("single region query is supported only")
+	}
+	return ds.newRegionTarget(pluginContext, target, regions[0])
+}
+
+// executionProgress returns the string to detect the progress of the query execution.
+func executionProgress(e *athena.QueryExecution) string {
+	var scanned int64
+	if e.Statistics != nil {
+		scanned = aws.Int64Value(e.Statistics.DataScannedInBytes)
+	}
+	return fmt.Sprintf("%s/%d", aws.StringValue(e.Status.State), scanned)
+}
+
+func newStatusFrame(refId string, executions []*athena.QueryExecution) *data.Frame {
+	frame := data.NewFrame("status",
+		data.NewField("time", nil, []time.Time{}),
+		data.NewField("queryExecutionId", nil, []string{}),
+		data.NewField("state", nil, []string{}),
+		data.NewField("dataScannedBytes", nil, []int64{}),
+		data.NewField("queueTimeMillis", nil, []int64{}),
+		data.NewField("engineExecutionTimeMillis", nil, []int64{}),
+	)
+	frame.RefID = refId
+	now := time.Now()
+	for _, e := range executions {
+		var scanned, queueTime, engineTime int64
+		if e.Statistics != nil {
+			scanned = aws.Int64Value(e.Statistics.DataScannedInBytes)
+			queueTime = aws.Int64Value(e.Statistics.QueryQueueTimeInMillis)
+			engineTime = aws.Int64Value(e.Statistics.EngineExecutionTimeInMillis)
+		}
+		frame.AppendRow(now, aws.StringValue(e.QueryExecutionId), aws.StringValue(e.Status.State), scanned, queueTime, engineTime)
+	}
+	return frame
+}
+
+// sendStreamError sends the error as the status frame notice, the stream is finished without retry.
+func sendStreamError(sender *backend.StreamSender, refId string, err error) error {
+	frame := newStatusFrame(refId, nil)
+	frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityError, Text: err.Error()})
+	return sender.SendFrame(frame, data.IncludeAll)
+}
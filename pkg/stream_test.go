@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+func TestStream(t *testing.T) {
+	t.Run("SubscribeStream", func(t *testing.T) {
+		ds := &AwsAthenaDatasource{streams: cache.New(STREAM_QUERY_TTL, time.Minute)}
+		pluginContext := backend.PluginContext{OrgID: 1, DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 2}}
+		ds.streams.Set(streamQueryCacheKey(2, "abc"), streamQuery{OrgID: 1}, STREAM_QUERY_TTL)
+
+		res, err := ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: pluginContext, Path: "query/abc"})
+		assert.NilError(t, err)
+		assert.Equal(t, backend.SubscribeStreamStatusOK, res.Status)
+
+		res, err = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: pluginContext, Path: "query/def"})
+		assert.NilError(t, err)
+		assert.Equal(t, backend.SubscribeStreamStatusNotFound, res.Status)
+
+		otherOrg := backend.PluginContext{OrgID: 3, DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 2}}
+		res, err = ds.SubscribeStream(context.Background(), &backend.SubscribeStreamRequest{PluginContext: otherOrg, Path: "query/abc"})
+		assert.NilError(t, err)
+		assert.Equal(t, backend.SubscribeStreamStatusPermissionDenied, res.Status)
+	})
+
+	t.Run("newStatusFrame", func(t *testing.T) {
+		executions := []*athena.QueryExecution{
+			{
+				QueryExecutionId: aws.String("id1"),
+				Status:           &athena.QueryExecutionStatus{State: aws.String("RUNNING")},
+				Statistics:       &athena.QueryExecutionStatistics{DataScannedInBytes: aws.Int64(100), QueryQueueTimeInMillis: aws.Int64(20)},
+			},
+			{
+				QueryExecutionId: aws.String("id2"),
+				Status:           &athena.QueryExecutionStatus{State: aws.String("QUEUED")},
+			},
+		}
+		frame := newStatusFrame("A", executions)
+		assert.Equal(t, "A", frame.RefID)
+		assert.Equal(t, 2, frame.Rows())
+		assert.Equal(t, "RUNNING", frame.Fields[2].At(0))
+		assert.Equal(t, int64(100), frame.Fields[3].At(0))
+		assert.Equal(t, int64(0), frame.Fields[3].At(1))
+		assert.Equal(t, "RUNNING/100", executionProgress(executions[0]))
+		assert.Equal(t, "QUEUED/0", executionProgress(executions[1]))
+	})
+	t.Run("filterNewRows", func(t *testing.T) {
+		t1 := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+		t2 := t1.Add(time.Minute)
+		t3 := t2.Add(time.Minute)
+		frame := data.NewFrame("",
+			data.NewField("ts", nil, []*time.Time{&t1, &t2, &t3, nil}),
+			data.NewField("value", nil, []*float64{aws.Float64(1), aws.Float64(2), aws.Float64(3), aws.Float64(4)}),
+		)
+		frame.RefID = "A"
+
+		rows := newTailRows()
+		newFrame, latest, err := rows.filterNewRows(frame, "ts", t2)
+		assert.NilError(t, err)
+		assert.Equal(t, "A", newFrame.RefID)
+		assert.Equal(t, 2, newFrame.Rows())
+		assert.Equal(t, 2.0, *newFrame.Fields[1].At(0).(*float64))
+		assert.Equal(t, t3, latest)
+
+		// the sent rows are not sent again by the overlapped query
+		newFrame, latest, err = rows.filterNewRows(frame, "ts", t1)
+		assert.NilError(t, err)
+		assert.Equal(t, 1, newFrame.Rows())
+		assert.Equal(t, 1.0, *newFrame.Fields[1].At(0).(*float64))
+		assert.Equal(t, t3, latest)
+
+		// the row which shares the last timestamp, and the late row in the overlap are sent
+		late := t2.Add(30 * time.Second)
+		frame = data.NewFrame("",
+			data.NewField("ts", nil, []*time.Time{&t2, &late, &t3, &t3}),
+			data.NewField("value", nil, []*float64{aws.Float64(2), aws.Float64(5), aws.Float64(3), aws.Float64(6)}),
+		)
+		newFrame, _, err = rows.filterNewRows(frame, "ts", t1)
+		assert.NilError(t, err)
+		assert.Equal(t, 2, newFrame.Rows())
+		assert.Equal(t, 5.0, *newFrame.Fields[1].At(0).(*float64))
+		assert.Equal(t, 6.0, *newFrame.Fields[1].At(1).(*float64))
+
+		// the rows before the window are forgotten
+		rows.prune(t3)
+		assert.Equal(t, 2, len(rows.seen))
+
+		_, _, err = rows.filterNewRows(frame, "time", t1)
+		assert.Error(t, err, "timestamp column not found: time")
+	})
+
+	t.Run("checkTailQuery", func(t *testing.T) {
+		target := AwsAthenaQuery{QueryString: "SELECT 1", TimestampColumn: "ts"}
+		assert.NilError(t, checkTailQuery(target, 30*time.Second))
+		assert.Error(t, checkTailQuery(target, time.Second), "tail interval should be 10s or longer")
+		assert.Error(t, checkTailQuery(AwsAthenaQuery{QueryString: "SELECT 1"}, 30*time.Second), "tail requires timestampColumn")
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/patrickmn/go-cache"
+	"gotest.tools/assert"
+)
+
+// The fixtures shared by the tests of the query pipeline and the resources.
+
+type resourceResponseFunc func(*backend.CallResourceResponse) error
+
+func (f resourceResponseFunc) Send(res *backend.CallResourceResponse) error { return f(res) }
+
+// fakeAthena serves the Athena API calls of the query, the query executions are in state. (SUCCEEDED by default)
+type fakeAthena struct {
+	lock  sync.Mutex
+	calls map[string]int
+	state string
+	// the request body of the last call of each action
+	bodies map[string][]byte
+}
+
+func newFakeAthenaServer(t *testing.T) (*fakeAthena, *httptest.Server) {
+	f := &fakeAthena{calls: make(map[string]int), state: "SUCCEEDED", bodies: make(map[string][]byte)}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		action := strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "AmazonAthena.")
+		body, err := ioutil.ReadAll(req.Body)
+		assert.NilError(t, err)
+		f.lock.Lock()
+		f.calls[action]++
+		f.bodies[action] = body
+		id := fmt.Sprintf("qid-%d", f.calls["StartQueryExecution"])
+		state := f.state
+		f.lock.Unlock()
+
+		execution := map[string]interface{}{
+			"QueryExecutionId": id,
+			"Query":            "SELECT 1",
+			"Status":           map[string]interface{}{"State": state},
+			"Statistics":       map[string]interface{}{"DataScannedInBytes": 100},
+		}
+		var resp interface{}
+		switch action {
+		case "GetWorkGroup":
+			resp = map[string]interface{}{"WorkGroup": map[string]interface{}{
+				"Name":          "primary",
+				"Configuration": map[string]interface{}{"BytesScannedCutoffPerQuery": 10000000},
+			}}
+		case "StartQueryExecution":
+			resp = map[string]interface{}{"QueryExecutionId": id}
+		case "BatchGetQueryExecution":
+			resp = map[string]interface{}{"QueryExecutions": []interface{}{execution}}
+		case "GetQueryExecution":
+			resp = map[string]interface{}{"QueryExecution": execution}
+		case "StopQueryExecution":
+			resp = map[string]interface{}{}
+		case "GetQueryResults":
+			resp = map[string]interface{}{"ResultSet": map[string]interface{}{
+				"ResultSetMetadata": map[string]interface{}{"ColumnInfo": []interface{}{
+					map[string]interface{}{"Name": "host", "Type": "varchar"},
+				}},
+				"Rows": []interface{}{
+					map[string]interface{}{"Data": []interface{}{map[string]interface{}{"VarCharValue": "host"}}},
+					map[string]interface{}{"Data": []interface{}{map[string]interface{}{"VarCharValue": "web-1"}}},
+				},
+			}}
+		default:
+			t.Errorf("unexpected Athena API call: %s", action)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		assert.NilError(t, json.NewEncoder(rw).Encode(resp))
+	}))
+	return f, server
+}
+
+// newTestDataSource returns the datasource without registering the metrics and starting the background loops.
+func newTestDataSource() *AwsAthenaDatasource {
+	ds := &AwsAthenaDatasource{
+		cache:   newQueryCache(300*time.Second, 5*time.Second),
+		metrics: newAwsAthenaMetrics(),
+		budget:  newScanBudget(),
+		audit:   newAuditLogger(),
+		im:      datasource.NewInstanceManager(newDataSourceInstance),
+		// the same expiration as the plugin
+		streams:      cache.New(STREAM_QUERY_TTL, 1*time.Minute),
+		asyncQueries: cache.New(ASYNC_QUERY_TTL, 1*time.Minute),
+	}
+	ds.prewarm = newPrewarmScheduler(ds)
+	return ds
+}
+
+func (f *fakeAthena) body(action string) []byte {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.bodies[action]
+}
+
+func (f *fakeAthena) count(action string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.calls[action]
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+)
+
+const tracerName = "github.com/mtanda/grafana-aws-athena-datasource"
+
+// initTracing configures the OTLP trace exporter by the standard OTEL_EXPORTER_OTLP_* environment variables,
+// and returns the function to flush the spans on exit. Tracing is disabled when the endpoint isn't set.
+func initTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// the exporter takes host:port, the scheme decides the transport security
+	insecure := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE") == "true"
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		endpoint = u.Host
+		if u.Scheme == "http" {
+			insecure = true
+		}
+	}
+	headers := parseOtlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+
+	var driver otlp.ProtocolDriver
+	if strings.HasPrefix(os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"), "http") {
+		opts := []otlphttp.Option{otlphttp.WithEndpoint(endpoint), otlphttp.WithHeaders(headers)}
+		if insecure {
+			opts = append(opts, otlphttp.WithInsecure())
+		}
+		driver = otlphttp.NewDriver(opts...)
+	} else {
+		opts := []otlpgrpc.Option{otlpgrpc.WithEndpoint(endpoint), otlpgrpc.WithHeaders(headers)}
+		if insecure {
+			opts = append(opts, otlpgrpc.WithInsecure())
+		}
+		driver = otlpgrpc.NewDriver(opts...)
+	}
+	exporter, err := otlp.NewExporter(context.Background(), driver)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "mtanda-aws-athena-datasource"
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+	otel.SetTracerProvider(tp)
+	backend.Logger.Info("Tracing enabled", "endpoint", endpoint)
+	return tp.Shutdown, nil
+}
+
+// parseOtlpHeaders parses "key1=value1,key2=value2" style headers.
+func parseOtlpHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if i := strings.Index(kv, "="); i != -1 {
+			if k, err := url.QueryUnescape(strings.TrimSpace(kv[:i])); err == nil {
+				if v, err := url.QueryUnescape(strings.TrimSpace(kv[i+1:])); err == nil {
+					headers[k] = v
+				}
+			}
+		}
+	}
+	return headers
+}
+
+// contextWithTraceHeaders returns the context which has the trace context in the headers from Grafana.
+func contextWithTraceHeaders(ctx context.Context, headers map[string]string) context.Context {
+	h := make(http.Header)
+	for k, v := range headers {
+		h.Set(k, v)
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error of the span and ends it, it is used with the named return error in defer.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/context"
+	"gotest.tools/assert"
+)
+
+// spanRecorder records the names of the ended spans.
+type spanRecorder struct {
+	lock  sync.Mutex
+	names []string
+}
+
+func (r *spanRecorder) OnStart(parent context.Context, s sdktrace.ReadWriteSpan) {}
+
+func (r *spanRecorder) OnEnd(s sdktrace.ReadOnlySpan) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.names = append(r.names, s.Name())
+}
+
+func (r *spanRecorder) Shutdown(ctx context.Context) error { return nil }
+
+func (r *spanRecorder) ForceFlush(ctx context.Context) error { return nil }
+
+func (r *spanRecorder) count(name string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	n := 0
+	for _, s := range r.names {
+		if s == name {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTracing(t *testing.T) {
+	t.Run("parseOtlpHeaders", func(t *testing.T) {
+		headers := parseOtlpHeaders("api-key=secret, x-scope-orgid = tenant%201,invalid")
+		assert.DeepEqual(t, map[string]string{"api-key": "secret", "x-scope-orgid": "tenant 1"}, headers)
+		assert.DeepEqual(t, map[string]string{}, parseOtlpHeaders(""))
+	})
+
+	t.Run("contextWithTraceHeaders", func(t *testing.T) {
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+		ctx := contextWithTraceHeaders(context.Background(), map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		})
+		sc := trace.RemoteSpanContextFromContext(ctx)
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", sc.SpanID().String())
+		assert.Assert(t, sc.IsRemote())
+	})
+
+	t.Run("credentials span", func(t *testing.T) {
+		recorder := &spanRecorder{}
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+		defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+		_, server := newFakeAthenaServer(t)
+		defer server.Close()
+		ds := newTestDataSource()
+		pluginContext := backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				ID:       103,
+				JSONData: []byte(`{"authType":"keys","defaultRegion":"us-east-1","athenaEndpoint":"` + server.URL + `"}`),
+				DecryptedSecureJSONData: map[string]string{
+					// the credentials of the other tests are cached
+					"accessKey": "AKID-TRACING",
+					"secretKey": "secret",
+				},
+			},
+		}
+		for _, refID := range []string{"A", "B"} {
+			resp, err := ds.QueryData(context.Background(), &backend.QueryDataRequest{
+				PluginContext: pluginContext,
+				Queries: []backend.DataQuery{
+					{RefID: refID, JSON: []byte(`{"refId":"` + refID + `","region":"default","workgroup":"primary","queryString":"SELECT 1","format":"table"}`)},
+				},
+			})
+			assert.NilError(t, err)
+			assert.NilError(t, resp.Responses[refID].Error)
+		}
+		// the credentials are retrieved once, and reused by the next query
+		assert.Equal(t, 1, recorder.count("credentials"))
+		assert.Equal(t, 2, recorder.count("getQueryResults"))
+	})
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource/httpadapter"
+	"golang.org/x/net/context"
+)
+
+const (
+	VARIABLE_QUERY_CACHE_DURATION = 5 * time.Minute
+	DEFAULT_VARIABLE_WORKGROUP    = "primary"
+)
+
+var (
+	variableQueryPattern = regexp.MustCompile(`(?s)^\s*([a-z_]+)\((.*)\)\s*$`)
+	// sql(region, workgroup, query) form is detected by the query part
+	sqlQueryPattern = regexp.MustCompile(`(?is)^\s*(SELECT|WITH|SHOW|VALUES)\b`)
+	// the last argument of these functions is the partition filter expression, which may have commas
+	variableQueryArgCounts = map[string]int{
+		"partitions":       4,
+		"partition_values": 6,
+	}
+)
+
+type metricFindValue struct {
+	Text  string `json:"text"`
+	Value string `json:"value"`
+}
+
+// variableQuery is the parsed query of the template variable, e.g. "tables(us-east-1, default)".
+type variableQuery struct {
+	Function string
+	Args     []string
+}
+
+func parseVariableQuery(query string) (*variableQuery, error) {
+	m := variableQueryPattern.FindStringSubmatch(query)
+	if m == nil {
+		return nil, fmt.Errorf("invalid variable query: %s", query)
+	}
+	vq := &variableQuery{Function: m[1], Args: make([]string, 0)}
+	if vq.Function == "sql" {
+		// the query may have commas
+		parts := strings.SplitN(m[2], ",", 3)
+		if len(parts) == 3 && sqlQueryPattern.MatchString(parts[2]) && !sqlQueryPattern.MatchString(parts[0]) {
+			vq.Args = []string{unquoteVariableArg(parts[0]), unquoteVariableArg(parts[1]), strings.TrimSpace(parts[2])}
+		} else {
+			vq.Args = []string{strings.TrimSpace(m[2])}
+		}
+		return vq, nil
+	}
+	if strings.TrimSpace(m[2]) != "" {
+		n, ok := variableQueryArgCounts[vq.Function]
+		if !ok {
+			n = -1
+		}
+		args := strings.SplitN(m[2], ",", n)
+		for i, arg := range args {
+			if ok && i == len(args)-1 && i == n-1 {
+				// the partition filter expression has the literals
+				vq.Args = append(vq.Args, strings.TrimSpace(arg))
+				continue
+			}
+			vq.Args = append(vq.Args, unquoteVariableArg(arg))
+		}
+	}
+	return vq, nil
+}
+
+// unquoteVariableArg trims the argument, and removes the quotes of the quoted argument such as 'default'.
+func unquoteVariableArg(arg string) string {
+	arg = strings.TrimSpace(arg)
+	if len(arg) < 2 {
+		return arg
+	}
+	for _, quote := range []byte{'\'', '"'} {
+		if arg[0] == quote && arg[len(arg)-1] == quote {
+			if value, n, err := readQuoted(arg, quote); err == nil && n == len(arg) {
+				return value
+			}
+		}
+	}
+	return arg
+}
+
+// arg returns the i-th argument, or the default value for the omitted optional argument.
+func (vq *variableQuery) arg(i int, defaultValue string) string {
+	if i < len(vq.Args) && vq.Args[i] != "" {
+		return vq.Args[i]
+	}
+	return defaultValue
+}
+
+func (vq *variableQuery) checkArgs(min int, max int) error {
+	if len(vq.Args) < min || len(vq.Args) > max {
+		if min == max {
+			return fmt.Errorf("%s() requires %d arguments", vq.Function, min)
+		}
+		return fmt.Errorf("%s() requires %d to %d arguments", vq.Function, min, max)
+	}
+	return nil
+}
+
+// region returns the region of the query, it is used for the cache key.
+func (vq *variableQuery) region() string {
+	switch vq.Function {
+	case "regions":
+		return "us-east-1"
+	case "sql":
+		if len(vq.Args) == 3 {
+			return vq.Args[0]
+		}
+		return "default"
+	default:
+		return vq.arg(0, "default")
+	}
+}
+
+func (ds *AwsAthenaDatasource) handleResourceVariableQuery(rw http.ResponseWriter, req *http.Request) {
+	backend.Logger.Debug("Received resource call", "url", req.URL.String(), "method", req.Method)
+	if req.Method != http.MethodGet {
+		return
+	}
+
+	ctx := req.Context()
+	pluginContext := httpadapter.PluginConfigFromContext(ctx)
+	urlQuery := req.URL.Query()
+
+	to := time.Now()
+	if urlQuery.Get("to") != "" {
+		t, err := time.Parse(time.RFC3339, urlQuery.Get("to"))
+		if err != nil {
+			writeResult(rw, "?", nil, err)
+			return
+		}
+		to = t
+	}
+	from := to.Add(-time.Hour)
+	if urlQuery.Get("from") != "" {
+		t, err := time.Parse(time.RFC3339, urlQuery.Get("from"))
+		if err != nil {
+			writeResult(rw, "?", nil, err)
+			return
+		}
+		from = t
+	}
+
+	// values of the template variables for the macros of sql() query
+	variables := make(map[string][]string)
+	if urlQuery.Get("variables") != "" {
+		if err := json.Unmarshal([]byte(urlQuery.Get("variables")), &variables); err != nil {
+			writeResult(rw, "?", nil, err)
+			return
+		}
+	}
+
+	values, err := ds.variableQuery(ctx, pluginContext, urlQuery.Get("query"), from, to, variables)
+	if err != nil {
+		writeResult(rw, "?", nil, err)
+		return
+	}
+
+	writeResult(rw, "variable_query", values, nil)
+}
+
+// variableQuery runs the query of the template variable, the results are cached by the query, the time range and the variables.
+func (ds *AwsAthenaDatasource) variableQuery(ctx context.Context, pluginContext backend.PluginContext, query string, from time.Time, to time.Time, variables map[string][]string) ([]metricFindValue, error) {
+	vq, err := parseVariableQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	vs, err := json.Marshal(variables)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := "VariableQuery/" + strconv.FormatInt(pluginContext.DataSourceInstanceSettings.ID, 10) + "/" + vq.region() + "/" + queryHash(query+"/"+from.UTC().Format(time.RFC3339)+"/"+to.UTC().Format(time.RFC3339)+"/"+string(vs))
+	if item, _, found := ds.cache.GetWithExpiration(cacheKey); found {
+		if values, ok := item.([]metricFindValue); ok {
+			return values, nil
+		}
+	}
+
+	var values []metricFindValue
+	switch vq.Function {
+	case "sql":
+		values, err = ds.sqlVariableQuery(ctx, pluginContext, vq, from, to, variables)
+	default:
+		var texts []string
+		texts, err = ds.listVariableValues(ctx, pluginContext, vq, to)
+		values = make([]metricFindValue, 0, len(texts))
+		for _, t := range texts {
+			values = append(values, metricFindValue{Text: t, Value: t})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	ds.cache.Set(cacheKey, values, VARIABLE_QUERY_CACHE_DURATION)
+
+	return values, nil
+}
+
+func (ds *AwsAthenaDatasource) listVariableValues(ctx context.Context, pluginContext backend.PluginContext, vq *variableQuery, to time.Time) ([]string, error) {
+	switch vq.Function {
+	case "regions":
+		if err := vq.checkArgs(0, 0); err != nil {
+			return nil, err
+		}
+		return ds.listRegions(ctx, pluginContext), nil
+	case "workgroup_names":
+		if err := vq.checkArgs(1, 1); err != nil {
+			return nil, err
+		}
+		return ds.getWorkgroupNames(ctx, pluginContext, vq.arg(0, ""))
+	case "named_query_names":
+		if err := vq.checkArgs(1, 2); err != nil {
+			return nil, err
+		}
+		return ds.getNamedQueryNames(ctx, pluginContext, vq.arg(0, ""), vq.arg(1, ""))
+	case "named_query_queries":
+		if err := vq.checkArgs(2, 3); err != nil {
+			return nil, err
+		}
+		return ds.getNamedQueryQueries(ctx, pluginContext, vq.arg(0, ""), vq.arg(2, ""), vq.arg(1, ""))
+	case "query_execution_ids", "query_execution_ids_by_name":
+		if err := vq.checkArgs(3, 4); err != nil {
+			return nil, err
+		}
+		limit, err := strconv.ParseInt(vq.arg(1, ""), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		getQueryExecutions := ds.getQueryExecutions
+		if vq.Function == "query_execution_ids_by_name" {
+			getQueryExecutions = ds.getQueryExecutionsByName
+		}
+		queryExecutions, err := getQueryExecutions(ctx, pluginContext, vq.arg(0, ""), vq.arg(3, ""), vq.arg(2, ""), to)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, 0)
+		for _, e := range limitQueryExecutions(queryExecutions, limit) {
+			ids = append(ids, *e.QueryExecutionId)
+		}
+		return ids, nil
+	case "databases":
+		if err := vq.checkArgs(1, 1); err != nil {
+			return nil, err
+		}
+		return ds.getDatabaseNames(ctx, pluginContext, vq.arg(0, ""))
+	case "tables":
+		if err := vq.checkArgs(2, 2); err != nil {
+			return nil, err
+		}
+		return ds.getTableNames(ctx, pluginContext, vq.arg(0, ""), vq.arg(1, ""))
+	case "columns":
+		if err := vq.checkArgs(3, 3); err != nil {
+			return nil, err
+		}
+		return ds.getColumnNames(ctx, pluginContext, vq.arg(0, ""), vq.arg(1, ""), vq.arg(2, ""))
+	case "partitions":
+		if err := vq.checkArgs(3, 4); err != nil {
+			return nil, err
+		}
+		return ds.getPartitionValues(ctx, pluginContext, vq.arg(0, ""), vq.arg(1, ""), vq.arg(2, ""), vq.arg(3, ""))
+	case "partition_values":
+		if err := vq.checkArgs(4, 6); err != nil {
+			return nil, err
+		}
+		return ds.getPartitionKeyValues(ctx, pluginContext, partitionQuery{
+			Region:     vq.arg(0, ""),
+			Database:   vq.arg(1, ""),
+			Table:      vq.arg(2, ""),
+			Key:        vq.arg(3, ""),
+			Order:      vq.arg(4, ""),
+			Expression: vq.arg(5, ""),
+		})
+	default:
+		return nil, fmt.Errorf("unknown variable query function: %s", vq.Function)
+	}
+}
+
+// sqlVariableQuery runs the query of the sql() function.
+func (ds *AwsAthenaDatasource) sqlVariableQuery(ctx context.Context, pluginContext backend.PluginContext, vq *variableQuery, from time.Time, to time.Time, variables map[string][]string) ([]metricFindValue, error) {
+	target := AwsAthenaQuery{
+		RefId:       "variable",
+		Region:      "default",
+		WorkGroup:   DEFAULT_VARIABLE_WORKGROUP,
+		QueryString: vq.Args[len(vq.Args)-1],
+		Variables:   variables,
+		From:        from,
+		To:          to,
+	}
+	if len(vq.Args) == 3 {
+		target.Region = vq.arg(0, "default")
+		target.WorkGroup = vq.arg(1, DEFAULT_VARIABLE_WORKGROUP)
+	}
+	if target.QueryString == "" {
+		return nil, fmt.Errorf("sql() requires the query")
+	}
+	if err := target.expandQueryString(); err != nil {
+		return nil, err
+	}
+	target, err := ds.newRegionTarget(pluginContext, target, target.Region)
+	if err != nil {
+		return nil, err
+	}
+	result, err := target.getQueryResults(ctx, pluginContext)
+	if err != nil {
+		return nil, err
+	}
+
+	return metricFindValues(result), nil
+}
+
+// metricFindValues returns the distinct values of the first column, or the __text and __value columns if exist.
+func metricFindValues(result *athena.GetQueryResultsOutput) []metricFindValue {
+	textIndex, valueIndex := 0, 0
+	for i, c := range result.ResultSet.ResultSetMetadata.ColumnInfo {
+		switch aws.StringValue(c.Name) {
+		case "__text":
+			textIndex = i
+		case "__value":
+			valueIndex = i
+		}
+	}
+	values := make([]metricFindValue, 0)
+	seen := make(map[metricFindValue]bool)
+	for _, row := range result.ResultSet.Rows {
+		if len(row.Data) == 0 {
+			continue
+		}
+		v := metricFindValue{Text: cellString(row.Data[textIndex]), Value: cellString(row.Data[valueIndex])}
+		if seen[v] {
+			continue
+		}
+		seen[v] = true
+		values = append(values, v)
+	}
+	return values
+}
+
+func (ds *AwsAthenaDatasource) getDatabaseNames(ctx context.Context, pluginContext backend.PluginContext, region string) ([]string, error) {
+	svc, err := ds.getGlueClient(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	err = svc.GetDatabasesPagesWithContext(ctx, &glue.GetDatabasesInput{},
+		func(page *glue.GetDatabasesOutput, lastPage bool) bool {
+			for _, d := range page.DatabaseList {
+				names = append(names, aws.StringValue(d.Name))
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (ds *AwsAthenaDatasource) getTableNames(ctx context.Context, pluginContext backend.PluginContext, region string, database string) ([]string, error) {
+	svc, err := ds.getGlueClient(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	err = svc.GetTablesPagesWithContext(ctx, &glue.GetTablesInput{DatabaseName: aws.String(database)},
+		func(page *glue.GetTablesOutput, lastPage bool) bool {
+			for _, t := range page.TableList {
+				names = append(names, aws.StringValue(t.Name))
+			}
+			return !lastPage
+		})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// getColumnNames returns the columns of the table, followed by the partition keys.
+func (ds *AwsAthenaDatasource) getColumnNames(ctx context.Context, pluginContext backend.PluginContext, region string, database string, table string) ([]string, error) {
+	svc, err := ds.getGlueClient(pluginContext, region)
+	if err != nil {
+		return nil, err
+	}
+	to, err := svc.GetTableWithContext(ctx, &glue.GetTableInput{
+		DatabaseName: aws.String(database),
+		Name:         aws.String(table),
+	})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0)
+	if to.Table.StorageDescriptor != nil {
+		for _, c := range to.Table.StorageDescriptor.Columns {
+			names = append(names, aws.StringValue(c.Name))
+		}
+	}
+	for _, c := range to.Table.PartitionKeys {
+		names = append(names, aws.StringValue(c.Name))
+	}
+	return names, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/athena"
+	"gotest.tools/assert"
+)
+
+func TestVariableQuery(t *testing.T) {
+	t.Run("parseVariableQuery", func(t *testing.T) {
+		vq, err := parseVariableQuery("regions()")
+		assert.NilError(t, err)
+		assert.Equal(t, "regions", vq.Function)
+		assert.Equal(t, 0, len(vq.Args))
+		assert.Equal(t, "us-east-1", vq.region())
+
+		vq, err = parseVariableQuery(" query_execution_ids(us-east-1, 5, ^SELECT, primary) ")
+		assert.NilError(t, err)
+		assert.Equal(t, "query_execution_ids", vq.Function)
+		assert.DeepEqual(t, []string{"us-east-1", "5", "^SELECT", "primary"}, vq.Args)
+		assert.Equal(t, "us-east-1", vq.region())
+		assert.Equal(t, "primary", vq.arg(3, ""))
+		assert.NilError(t, vq.checkArgs(3, 4))
+
+		vq, err = parseVariableQuery("named_query_names(us-east-1)")
+		assert.NilError(t, err)
+		assert.Equal(t, "", vq.arg(1, ""))
+		assert.Error(t, vq.checkArgs(3, 3), "named_query_names() requires 3 arguments")
+
+		vq, err = parseVariableQuery(`tables('us-east-1', "default")`)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"us-east-1", "default"}, vq.Args)
+
+		vq, err = parseVariableQuery(`partitions('us-east-1', 'default', 'logs', dt >= '2021-01-01')`)
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"us-east-1", "default", "logs", "dt >= '2021-01-01'"}, vq.Args)
+
+		_, err = parseVariableQuery("tables")
+		assert.Error(t, err, "invalid variable query: tables")
+	})
+
+	t.Run("parseVariableQuery sql", func(t *testing.T) {
+		vq, err := parseVariableQuery("sql(SELECT DISTINCT host, region FROM logs WHERE region IN ('a', 'b'))")
+		assert.NilError(t, err)
+		assert.Equal(t, "sql", vq.Function)
+		assert.DeepEqual(t, []string{"SELECT DISTINCT host, region FROM logs WHERE region IN ('a', 'b')"}, vq.Args)
+		assert.Equal(t, "default", vq.region())
+
+		vq, err = parseVariableQuery("sql(ap-northeast-1, analytics, SELECT host FROM logs)")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"ap-northeast-1", "analytics", "SELECT host FROM logs"}, vq.Args)
+		assert.Equal(t, "ap-northeast-1", vq.region())
+
+		vq, err = parseVariableQuery("sql('ap-northeast-1', 'analytics', SELECT host FROM logs WHERE env = 'prod')")
+		assert.NilError(t, err)
+		assert.DeepEqual(t, []string{"ap-northeast-1", "analytics", "SELECT host FROM logs WHERE env = 'prod'"}, vq.Args)
+	})
+
+	t.Run("metricFindValues", func(t *testing.T) {
+		resp := &athena.GetQueryResultsOutput{
+			ResultSet: &athena.ResultSet{
+				ResultSetMetadata: &athena.ResultSetMetadata{
+					ColumnInfo: []*athena.ColumnInfo{
+						{Name: aws.String("host"), Type: aws.String("varchar")},
+					},
+				},
+				Rows: []*athena.Row{
+					{Data: []*athena.Datum{{VarCharValue: aws.String("a")}}},
+					{Data: []*athena.Datum{{VarCharValue: aws.String("b")}}},
+					{Data: []*athena.Datum{{VarCharValue: aws.String("a")}}},
+				},
+			},
+		}
+		assert.DeepEqual(t, []metricFindValue{{Text: "a", Value: "a"}, {Text: "b", Value: "b"}}, metricFindValues(resp))
+
+		resp = &athena.GetQueryResultsOutput{
+			ResultSet: &athena.ResultSet{
+				ResultSetMetadata: &athena.ResultSetMetadata{
+					ColumnInfo: []*athena.ColumnInfo{
+						{Name: aws.String("__value"), Type: aws.String("varchar")},
+						{Name: aws.String("__text"), Type: aws.String("varchar")},
+					},
+				},
+				Rows: []*athena.Row{
+					{Data: []*athena.Datum{{VarCharValue: aws.String("i-1")}, {VarCharValue: aws.String("web")}}},
+				},
+			},
+		}
+		assert.DeepEqual(t, []metricFindValue{{Text: "web", Value: "i-1"}}, metricFindValues(resp))
+	})
+}
@@ -15,6 +15,8 @@ const authProviderOptions: Array<SelectableValue<string>> = [
   { label: 'Access & secret key', value: 'keys' },
   { label: 'Credentials file', value: 'credentials' },
   { label: 'ARN', value: 'arn' },
+  { label: 'Web identity', value: 'web_identity' },
+  { label: 'SSO profile', value: 'sso' },
 ];
 
 const regions: Array<SelectableValue<string>> = [
@@ -47,6 +49,15 @@ const regions: Array<SelectableValue<string>> = [
   return { label: r, value: r };
 });
 
+const endpointOptions: Array<{ label: string; key: keyof AwsAthenaOptions; placeholder: string }> = [
+  { label: 'Athena Endpoint', key: 'athenaEndpoint', placeholder: 'https://athena.<region>.amazonaws.com' },
+  { label: 'STS Endpoint', key: 'stsEndpoint', placeholder: 'https://sts.<region>.amazonaws.com' },
+  { label: 'EC2 Endpoint', key: 'ec2Endpoint', placeholder: 'https://ec2.<region>.amazonaws.com' },
+  { label: 'S3 Endpoint', key: 's3Endpoint', placeholder: 'https://s3.<region>.amazonaws.com' },
+  { label: 'Glue Endpoint', key: 'glueEndpoint', placeholder: 'https://glue.<region>.amazonaws.com' },
+  { label: 'HTTP Proxy', key: 'httpProxy', placeholder: 'http://proxy:3128' },
+];
+
 export type Props = DataSourcePluginOptionsEditorProps<AwsAthenaOptions, AwsAthenaSecureJsonData>;
 
 export class ConfigEditor extends PureComponent<Props> {
@@ -79,7 +90,7 @@ export class ConfigEditor extends PureComponent<Props> {
               />
             </div>
           </div>
-          {options.jsonData.authType === 'credentials' && (
+          {(options.jsonData.authType === 'credentials' || options.jsonData.authType === 'sso') && (
             <div className="gf-form-inline">
               <div className="gf-form">
                 <InlineFormLabel
@@ -168,18 +179,82 @@ export class ConfigEditor extends PureComponent<Props> {
             </div>
           )}
           {options.jsonData.authType === 'arn' && (
-            <div className="gf-form-inline">
-              <div className="gf-form">
-                <InlineFormLabel className="width-14" tooltip="ARN of Assume Role">
-                  Assume Role ARN
-                </InlineFormLabel>
-                <div className="width-30">
-                  <Input
-                    className="width-30"
-                    placeholder="arn:aws:iam:*"
-                    value={options.jsonData.assumeRoleArn || ''}
-                    onChange={onUpdateDatasourceJsonDataOption(this.props, 'assumeRoleArn')}
-                  />
+            <div>
+              <div className="gf-form-inline">
+                <div className="gf-form">
+                  <InlineFormLabel className="width-14" tooltip="ARN of Assume Role">
+                    Assume Role ARN
+                  </InlineFormLabel>
+                  <div className="width-30">
+                    <Input
+                      className="width-30"
+                      placeholder="arn:aws:iam:*"
+                      value={options.jsonData.assumeRoleArn || ''}
+                      onChange={onUpdateDatasourceJsonDataOption(this.props, 'assumeRoleArn')}
+                    />
+                  </div>
+                </div>
+              </div>
+              <div className="gf-form-inline">
+                <div className="gf-form">
+                  <InlineFormLabel className="width-14" tooltip="External ID required by the trust policy of the role">
+                    External ID
+                  </InlineFormLabel>
+                  <div className="width-30">
+                    <Input
+                      className="width-30"
+                      value={options.jsonData.externalId || ''}
+                      onChange={onUpdateDatasourceJsonDataOption(this.props, 'externalId')}
+                    />
+                  </div>
+                </div>
+              </div>
+              <div className="gf-form-inline">
+                <div className="gf-form">
+                  <InlineFormLabel
+                    className="width-14"
+                    tooltip="Session name of Assume Role, {{orgId}}, {{datasourceId}} and {{datasourceName}} are available."
+                  >
+                    Session Name
+                  </InlineFormLabel>
+                  <div className="width-30">
+                    <Input
+                      className="width-30"
+                      placeholder="GrafanaSession"
+                      value={options.jsonData.assumeRoleSessionName || ''}
+                      onChange={onUpdateDatasourceJsonDataOption(this.props, 'assumeRoleSessionName')}
+                    />
+                  </div>
+                </div>
+              </div>
+              <div className="gf-form-inline">
+                <div className="gf-form">
+                  <InlineFormLabel className="width-14" tooltip="Duration of Assume Role session">
+                    Session Duration
+                  </InlineFormLabel>
+                  <div className="width-30">
+                    <Input
+                      className="width-30"
+                      placeholder="15m"
+                      value={options.jsonData.assumeRoleDuration || ''}
+                      onChange={onUpdateDatasourceJsonDataOption(this.props, 'assumeRoleDuration')}
+                    />
+                  </div>
+                </div>
+              </div>
+              <div className="gf-form-inline">
+                <div className="gf-form">
+                  <InlineFormLabel className="width-14" tooltip="ARN of intermediate role, assumed before Assume Role ARN">
+                    Intermediate Role ARN
+                  </InlineFormLabel>
+                  <div className="width-30">
+                    <Input
+                      className="width-30"
+                      placeholder="arn:aws:iam:*"
+                      value={options.jsonData.intermediateRoleArn || ''}
+                      onChange={onUpdateDatasourceJsonDataOption(this.props, 'intermediateRoleArn')}
+                    />
+                  </div>
                 </div>
               </div>
             </div>
@@ -215,6 +290,26 @@ export class ConfigEditor extends PureComponent<Props> {
             </div>
           </div>
         </div>
+        <h3 className="page-heading">Custom Endpoints</h3>
+        <div className="gf-form-group">
+          {endpointOptions.map(endpoint => (
+            <div className="gf-form-inline" key={endpoint.key}>
+              <div className="gf-form">
+                <InlineFormLabel className="width-14" tooltip="Leave blank to use the default endpoint.">
+                  {endpoint.label}
+                </InlineFormLabel>
+                <div className="width-30">
+                  <Input
+                    className="width-30"
+                    placeholder={endpoint.placeholder}
+                    value={(options.jsonData[endpoint.key] as string) || ''}
+                    onChange={onUpdateDatasourceJsonDataOption(this.props, endpoint.key)}
+                  />
+                </div>
+              </div>
+            </div>
+          ))}
+        </div>
       </>
     );
   }
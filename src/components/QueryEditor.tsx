@@ -1,21 +1,51 @@
 import React, { PureComponent } from 'react';
-import { QueryEditorProps } from '@grafana/data';
-import { InlineFormLabel, SegmentAsync, QueryField } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
+import { InlineFormLabel, Segment, SegmentAsync, QueryField } from '@grafana/ui';
 import { DataSource } from '../datasource';
-import { AwsAthenaQuery, AwsAthenaOptions } from '../types';
+import { AwsAthenaQuery, AwsAthenaOptions, AwsAthenaFormat, AwsAthenaStream } from '../types';
+
+const formatOptions: Array<SelectableValue<AwsAthenaFormat>> = [
+  { label: 'Time series / Table', value: '' },
+  { label: 'Logs', value: 'logs' },
+  { label: 'Logs volume', value: 'logs_volume' },
+  { label: 'Annotations', value: 'annotations' },
+];
+
+const streamOptions: Array<SelectableValue<AwsAthenaStream>> = [
+  { label: 'Off', value: '' },
+  { label: 'Progress', value: 'progress' },
+  { label: 'Tail', value: 'tail' },
+];
+
+const asyncOptions: Array<SelectableValue<boolean>> = [
+  { label: 'Off', value: false },
+  { label: 'On', value: true },
+];
 
 type Props = QueryEditorProps<DataSource, AwsAthenaQuery, AwsAthenaOptions>;
 
 interface State {
   region: string;
   workgroup: string;
+  assumeRoleArn: string;
   queryExecutionId: string;
   timestampColumn: string;
   valueColumn: string;
   legendFormat: string;
+  format: AwsAthenaFormat;
+  messageColumn: string;
+  levelColumn: string;
+  timeEndColumn: string;
+  titleColumn: string;
+  textColumn: string;
+  tagsColumn: string;
   timeFormat: string;
   maxRows: string;
   cacheDuration: string;
+  timeAlignment: string;
+  stream: AwsAthenaStream;
+  tailInterval: string;
+  async: boolean;
   queryString: string;
 }
 
@@ -27,13 +57,25 @@ export class QueryEditor extends PureComponent<Props, State> {
     const defaultQuery: Partial<AwsAthenaQuery> = {
       region: 'default',
       workgroup: '',
+      assumeRoleArn: '',
       queryExecutionId: '',
       timestampColumn: '',
       valueColumn: '',
       legendFormat: '',
+      format: '',
+      messageColumn: '',
+      levelColumn: '',
+      timeEndColumn: '',
+      titleColumn: '',
+      textColumn: '',
+      tagsColumn: '',
       timeFormat: '',
       maxRows: '',
       cacheDuration: '',
+      timeAlignment: '',
+      stream: '',
+      tailInterval: '',
+      async: false,
       queryString: '',
     };
     const query = Object.assign({}, defaultQuery, props.query);
@@ -41,13 +83,25 @@ export class QueryEditor extends PureComponent<Props, State> {
     this.state = {
       region: query.region,
       workgroup: query.workgroup,
+      assumeRoleArn: query.assumeRoleArn,
       queryExecutionId: query.queryExecutionId,
       timestampColumn: query.timestampColumn,
       valueColumn: query.valueColumn,
       legendFormat: query.legendFormat,
+      format: query.format || '',
+      messageColumn: query.messageColumn || '',
+      levelColumn: query.levelColumn || '',
+      timeEndColumn: query.timeEndColumn || '',
+      titleColumn: query.titleColumn || '',
+      textColumn: query.textColumn || '',
+      tagsColumn: query.tagsColumn || '',
       timeFormat: query.timeFormat,
       maxRows: query.maxRows,
       cacheDuration: query.cacheDuration,
+      timeAlignment: query.timeAlignment || '',
+      stream: query.stream || '',
+      tailInterval: query.tailInterval || '',
+      async: query.async || false,
       queryString: query.queryString,
     };
   }
@@ -100,6 +154,12 @@ export class QueryEditor extends PureComponent<Props, State> {
     }
   };
 
+  onAssumeRoleArnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const assumeRoleArn = e.currentTarget.value;
+    this.query.assumeRoleArn = assumeRoleArn;
+    this.setState({ assumeRoleArn });
+  };
+
   onTimestampColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
     const timestampColumn = e.currentTarget.value;
     this.query.timestampColumn = timestampColumn;
@@ -118,6 +178,69 @@ export class QueryEditor extends PureComponent<Props, State> {
     this.setState({ legendFormat });
   };
 
+  onFormatChange = (item: SelectableValue<AwsAthenaFormat>) => {
+    const format = item.value || '';
+    this.query.format = format;
+    this.setState({ format });
+    this.onRunQuery();
+  };
+
+  onStreamChange = (item: SelectableValue<AwsAthenaStream>) => {
+    const stream = item.value || '';
+    this.query.stream = stream;
+    this.setState({ stream });
+    this.onRunQuery();
+  };
+
+  onTailIntervalChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const tailInterval = e.currentTarget.value;
+    this.query.tailInterval = tailInterval;
+    this.setState({ tailInterval });
+  };
+
+  onAsyncChange = (item: SelectableValue<boolean>) => {
+    const async = item.value || false;
+    this.query.async = async;
+    this.setState({ async });
+    this.onRunQuery();
+  };
+
+  onMessageColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const messageColumn = e.currentTarget.value;
+    this.query.messageColumn = messageColumn;
+    this.setState({ messageColumn });
+  };
+
+  onLevelColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const levelColumn = e.currentTarget.value;
+    this.query.levelColumn = levelColumn;
+    this.setState({ levelColumn });
+  };
+
+  onTimeEndColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const timeEndColumn = e.currentTarget.value;
+    this.query.timeEndColumn = timeEndColumn;
+    this.setState({ timeEndColumn });
+  };
+
+  onTitleColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const titleColumn = e.currentTarget.value;
+    this.query.titleColumn = titleColumn;
+    this.setState({ titleColumn });
+  };
+
+  onTextColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const textColumn = e.currentTarget.value;
+    this.query.textColumn = textColumn;
+    this.setState({ textColumn });
+  };
+
+  onTagsColumnChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const tagsColumn = e.currentTarget.value;
+    this.query.tagsColumn = tagsColumn;
+    this.setState({ tagsColumn });
+  };
+
   onTimeFormatChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
     const timeFormat = e.currentTarget.value;
     this.query.timeFormat = timeFormat;
@@ -136,6 +259,12 @@ export class QueryEditor extends PureComponent<Props, State> {
     this.setState({ cacheDuration });
   };
 
+  onTimeAlignmentChange = (e: React.SyntheticEvent<HTMLInputElement>) => {
+    const timeAlignment = e.currentTarget.value;
+    this.query.timeAlignment = timeAlignment;
+    this.setState({ timeAlignment });
+  };
+
   onQueryStringChange = (value: string, override?: boolean) => {
     const { query, onChange, onRunQuery } = this.props;
     const queryString = value;
@@ -160,13 +289,25 @@ export class QueryEditor extends PureComponent<Props, State> {
     const {
       region,
       workgroup,
+      assumeRoleArn,
       queryExecutionId,
       timestampColumn,
       valueColumn,
       legendFormat,
+      format,
+      messageColumn,
+      levelColumn,
+      timeEndColumn,
+      titleColumn,
+      textColumn,
+      tagsColumn,
       timeFormat,
       maxRows,
       cacheDuration,
+      timeAlignment,
+      stream,
+      tailInterval,
+      async,
       queryString,
     } = this.state;
     return (
@@ -193,6 +334,20 @@ export class QueryEditor extends PureComponent<Props, State> {
               onChange={this.onWorkgroupChange}
             ></SegmentAsync>
           </div>
+
+          <div className="gf-form">
+            <InlineFormLabel width={8} tooltip="Role to assume for this query, should be allowed in the datasource settings">
+              Assume Role ARN
+            </InlineFormLabel>
+            <input
+              type="text"
+              className="gf-form-input width-30"
+              placeholder="arn:aws:iam:*"
+              value={assumeRoleArn}
+              onChange={this.onAssumeRoleArnChange}
+              onBlur={this.onRunQuery}
+            />
+          </div>
         </div>
 
         {queryString === '' && (
@@ -226,6 +381,141 @@ export class QueryEditor extends PureComponent<Props, State> {
           </div>
         )}
 
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <InlineFormLabel width={8}>Format</InlineFormLabel>
+            <Segment
+              options={formatOptions}
+              value={formatOptions.find(o => o.value === format)}
+              onChange={this.onFormatChange}
+            ></Segment>
+          </div>
+
+          <div className="gf-form">
+            <InlineFormLabel width={8} tooltip="Stream the query through Grafana Live (Grafana 8 or later)">
+              Stream
+            </InlineFormLabel>
+            <Segment
+              options={streamOptions}
+              value={streamOptions.find(o => o.value === stream)}
+              onChange={this.onStreamChange}
+            ></Segment>
+          </div>
+
+          {stream === 'tail' && (
+            <div className="gf-form">
+              <InlineFormLabel width={8}>Tail Interval</InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="30s"
+                value={tailInterval}
+                onChange={this.onTailIntervalChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+          )}
+
+          {queryString !== '' && stream === '' && (
+            <div className="gf-form">
+              <InlineFormLabel width={8} tooltip="Poll the query execution state instead of waiting in a query request">
+                Async
+              </InlineFormLabel>
+              <Segment
+                options={asyncOptions}
+                value={asyncOptions.find(o => o.value === async)}
+                onChange={this.onAsyncChange}
+              ></Segment>
+            </div>
+          )}
+
+          {(format === 'logs' || format === 'logs_volume') && (
+            <div className="gf-form">
+              <InlineFormLabel width={8} tooltip="Detected from the column names when empty">
+                Level Column
+              </InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="level"
+                value={levelColumn}
+                onChange={this.onLevelColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+          )}
+
+          {format === 'logs' && (
+            <div className="gf-form">
+              <InlineFormLabel width={8} tooltip="Detected from the column names when empty">
+                Message Column
+              </InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="message"
+                value={messageColumn}
+                onChange={this.onMessageColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+          )}
+        </div>
+
+        {format === 'annotations' && (
+          <div className="gf-form-inline">
+            <div className="gf-form">
+              <InlineFormLabel width={8}>Time End Column</InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="timeEnd"
+                value={timeEndColumn}
+                onChange={this.onTimeEndColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+
+            <div className="gf-form">
+              <InlineFormLabel width={8}>Title Column</InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="title"
+                value={titleColumn}
+                onChange={this.onTitleColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+
+            <div className="gf-form">
+              <InlineFormLabel width={8}>Text Column</InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="text"
+                value={textColumn}
+                onChange={this.onTextColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+
+            <div className="gf-form">
+              <InlineFormLabel width={8} tooltip="Comma separated string or array column">
+                Tags Column
+              </InlineFormLabel>
+              <input
+                type="text"
+                className="gf-form-input"
+                placeholder="tags"
+                value={tagsColumn}
+                onChange={this.onTagsColumnChange}
+                onBlur={this.onRunQuery}
+              />
+            </div>
+          </div>
+        )}
+
         <div className="gf-form-inline">
           <div className="gf-form">
             <InlineFormLabel width={8}>Legend Format</InlineFormLabel>
@@ -262,6 +552,20 @@ export class QueryEditor extends PureComponent<Props, State> {
               onBlur={this.onRunQuery}
             />
           </div>
+
+          <div className="gf-form">
+            <InlineFormLabel width={8} tooltip="Align the time range of the macros, e.g. 1h to share the cache with the pre-warmed query">
+              Time Alignment
+            </InlineFormLabel>
+            <input
+              type="text"
+              className="gf-form-input"
+              placeholder="1m"
+              value={timeAlignment}
+              onChange={this.onTimeAlignmentChange}
+              onBlur={this.onRunQuery}
+            />
+          </div>
         </div>
 
         <div className="gf-form-inline">
@@ -1,6 +1,27 @@
-import { DataSourceInstanceSettings, MetricFindValue, SelectableValue, ScopedVars } from '@grafana/data';
-import { DataSourceWithBackend, getTemplateSrv } from '@grafana/runtime';
-import { AwsAthenaQuery, AwsAthenaOptions } from './types';
+import {
+  DataQueryRequest,
+  DataQueryResponse,
+  DataSourceInstanceSettings,
+  MetricFindValue,
+  SelectableValue,
+  ScopedVars,
+} from '@grafana/data';
+import * as runtime from '@grafana/runtime';
+import { DataSourceWithBackend, getTemplateSrv, toDataQueryResponse } from '@grafana/runtime';
+import { Observable, from, merge } from 'rxjs';
+import { mergeMap } from 'rxjs/operators';
+import { AwsAthenaQuery, AwsAthenaOptions, AwsAthenaAsyncQueryStatus } from './types';
+
+const ASYNC_QUERY_POLL_INTERVAL = 2000;
+// the argument of the template variable macros is the variable name, with or without `$` as the backend accepts
+const MACRO_VARIABLE_PATTERN = /\$__(in|value|ident)\(\s*\$?(\w+)\s*\)/g;
+
+// interpolateQueryString interpolates the plain template variables with the default format,
+// the variable names in the macros are kept for the backend, e.g. $__in($host) is sent as $__in(host).
+function interpolateQueryString(queryString: string, scopedVars?: ScopedVars): string {
+  const macros = queryString.replace(MACRO_VARIABLE_PATTERN, (_, macro, name) => `$__${macro}(${name})`);
+  return getTemplateSrv().replace(macros, scopedVars);
+}
 
 export class DataSource extends DataSourceWithBackend<AwsAthenaQuery, AwsAthenaOptions> {
   defaultRegion: string;
@@ -10,12 +31,63 @@ export class DataSource extends DataSourceWithBackend<AwsAthenaQuery, AwsAthenaO
     super(instanceSettings);
     this.defaultRegion = instanceSettings.jsonData.defaultRegion || 'us-east-1';
     this.outputLocation = instanceSettings.jsonData.outputLocation;
+    // annotations are queried by the query editor with the annotations format
+    this.annotations = {};
+  }
+
+  query(request: DataQueryRequest<AwsAthenaQuery>): Observable<DataQueryResponse> {
+    // identifiers for the audit log
+    request.targets = request.targets.map(target => ({
+      ...target,
+      dashboardId: request.dashboardId,
+      panelId: request.panelId,
+    }));
+    // Grafana Live is available in Grafana 8 or later, the streamed queries run as the normal queries before it
+    const live = (runtime as any).getGrafanaLiveSrv ? (runtime as any).getGrafanaLiveSrv() : undefined;
+    const streamed = live ? request.targets.filter(target => target.stream && !target.hide) : [];
+    // the query execution id query has nothing to wait, it runs as the normal query
+    const asynchronous = request.targets.filter(
+      target => target.async && target.queryString && !target.hide && !streamed.includes(target)
+    );
+    if (streamed.length === 0 && asynchronous.length === 0) {
+      return super.query(request);
+    }
+    const responses = [
+      ...streamed.map(target => this.streamQuery(live, request, target)),
+      ...asynchronous.map(target => this.runAsyncQuery(request, target)),
+    ];
+    const targets = request.targets.filter(target => !streamed.includes(target) && !asynchronous.includes(target));
+    if (targets.length > 0) {
+      responses.push(super.query({ ...request, targets }));
+    }
+    return merge(...responses);
+  }
+
+  // streamQuery registers the query by the stream_query resource, and subscribes the returned channel.
+  // The progress stream sends the status frame and the result frames, the tail stream appends the new rows.
+  streamQuery(live: any, request: DataQueryRequest<AwsAthenaQuery>, target: AwsAthenaQuery): Observable<DataQueryResponse> {
+    const query = this.applyTemplateVariables({ ...target }, request.scopedVars);
+    const body = {
+      from: request.range.from.toISOString(),
+      to: request.range.to.toISOString(),
+      tailInterval: target.stream === 'tail' ? target.tailInterval || '30s' : '',
+      query,
+    };
+    return from(this.postResource('stream_query', body)).pipe(
+      mergeMap(res =>
+        live.getDataStream({
+          addr: { scope: 'ds', namespace: this.uid, path: res['stream_query']['path'] },
+          key: `${request.requestId}/${target.refId}`,
+        }) as Observable<DataQueryResponse>
+      )
+    );
   }
 
   applyTemplateVariables(query: AwsAthenaQuery, scopedVars: ScopedVars) {
     // TODO: pass scopedVars to templateSrv.replace()
     const templateSrv = getTemplateSrv();
     query.region = templateSrv.replace(query.region, scopedVars);
+    query.assumeRoleArn = templateSrv.replace(query.assumeRoleArn || '', scopedVars);
     query.maxRows = query.maxRows || '';
     query.cacheDuration = query.cacheDuration || '';
     if (typeof query.queryString === 'undefined' || query.queryString === '') {
@@ -29,11 +101,108 @@ export class DataSource extends DataSourceWithBackend<AwsAthenaQuery, AwsAthenaO
       query.queryExecutionId = '';
       query.inputs = [];
     }
-    query.queryString = templateSrv.replace(query.queryString, scopedVars) || '';
+    // variables of the $__in(), $__value() and $__ident() macros are quoted in the backend
+    query.variables = this.getMacroVariables(query.queryString || '', scopedVars);
+    query.queryString = interpolateQueryString(query.queryString || '', scopedVars);
     query.outputLocation = this.outputLocation;
     return query;
   }
 
+  async startAsyncQuery(
+    request: DataQueryRequest<AwsAthenaQuery>,
+    target: AwsAthenaQuery
+  ): Promise<{ queryExecutionId: string; warnings: string[] }> {
+    const query = this.applyTemplateVariables({ ...target }, request.scopedVars);
+    const body = {
+      from: request.range.from.toISOString(),
+      to: request.range.to.toISOString(),
+      query,
+    };
+    return (await this.postResource('async_query_start', body))['async_query_start'];
+  }
+
+  async pollAsyncQuery(queryExecutionId: string): Promise<AwsAthenaAsyncQueryStatus> {
+    return (await this.getResource('async_query_poll', { queryExecutionId: queryExecutionId }))['async_query_poll'];
+  }
+
+  async getAsyncQueryResults(queryExecutionId: string): Promise<DataQueryResponse> {
+    const results = (await this.getResource('async_query_results', { queryExecutionId: queryExecutionId }))[
+      'async_query_results'
+    ];
+    return toDataQueryResponse({ data: results });
+  }
+
+  async cancelAsyncQuery(queryExecutionId: string): Promise<void> {
+    await this.postResource(`async_query_cancel?queryExecutionId=${encodeURIComponent(queryExecutionId)}`);
+  }
+
+  // runAsyncQuery starts the query execution, polls the state until it is completed, and returns the results.
+  // The query execution is cancelled when the subscription is closed before the completion.
+  runAsyncQuery(
+    request: DataQueryRequest<AwsAthenaQuery>,
+    target: AwsAthenaQuery,
+    onStatus?: (status: AwsAthenaAsyncQueryStatus) => void
+  ): Observable<DataQueryResponse> {
+    return new Observable<DataQueryResponse>(subscriber => {
+      let queryExecutionId = '';
+      let completed = false;
+      let timer: any;
+      const poll = async () => {
+        try {
+          const status = await this.pollAsyncQuery(queryExecutionId);
+          if (onStatus) {
+            onStatus(status);
+          }
+          if (status.state === 'QUEUED' || status.state === 'RUNNING') {
+            timer = setTimeout(poll, ASYNC_QUERY_POLL_INTERVAL);
+            return;
+          }
+          completed = true;
+          if (status.state !== 'SUCCEEDED') {
+            throw new Error(`query execution is ${status.state}: ${status.stateChangeReason || ''}`);
+          }
+          subscriber.next(await this.getAsyncQueryResults(queryExecutionId));
+          subscriber.complete();
+        } catch (err) {
+          completed = true;
+          subscriber.error(err);
+        }
+      };
+      this.startAsyncQuery(request, target).then(started => {
+        queryExecutionId = started.queryExecutionId;
+        poll();
+      }, err => {
+        completed = true;
+        subscriber.error(err);
+      });
+      return () => {
+        clearTimeout(timer);
+        if (queryExecutionId !== '' && !completed) {
+          this.cancelAsyncQuery(queryExecutionId);
+        }
+      };
+    });
+  }
+
+  getMacroVariables(queryString: string, scopedVars?: ScopedVars): Record<string, string[]> {
+    const templateSrv = getTemplateSrv();
+    const variables: Record<string, string[]> = {};
+    const macroPattern = new RegExp(MACRO_VARIABLE_PATTERN.source, 'g');
+    let m;
+    while ((m = macroPattern.exec(queryString)) !== null) {
+      const name = m[2];
+      let values: string[] = [];
+      const replaced = templateSrv.replace('$' + name, scopedVars, (value: string | string[]) => {
+        values = (Array.isArray(value) ? value : [value]).map(v => String(v));
+        return '';
+      });
+      if (replaced !== '$' + name) {
+        variables[name] = values;
+      }
+    }
+    return variables;
+  }
+
   async getRegionOptions(): Promise<Array<SelectableValue<string>>> {
     const regions = await this.getRegions();
     return regions.map(name => ({ label: name, value: name } as SelectableValue<string>));
@@ -113,105 +282,16 @@ export class DataSource extends DataSourceWithBackend<AwsAthenaQuery, AwsAthenaO
 
   async metricFindQuery?(query: any, options?: any): Promise<MetricFindValue[]> {
     const templateSrv = getTemplateSrv();
-
-    const regionsQuery = query.match(/^regions\(\)/);
-    if (regionsQuery) {
-      const regions = await this.getRegions();
-      return regions.map(n => {
-        return { text: n, value: n };
-      });
-    }
-
-    const workgroupNamesQuery = query.match(/^workgroup_names\(([^\)]+?)\)/);
-    if (workgroupNamesQuery) {
-      const region = templateSrv.replace(workgroupNamesQuery[1]);
-      const workgroupNames = await this.getWorkgroupNames(region);
-      return workgroupNames.map(n => {
-        return { text: n, value: n };
-      });
-    }
-
-    const namedQueryNamesQuery = query.match(/^named_query_names\(([^\)]+?)(,\s?.+)?\)/);
-    if (namedQueryNamesQuery) {
-      const region = templateSrv.replace(namedQueryNamesQuery[1]);
-      let workGroup = namedQueryNamesQuery[2];
-      if (workGroup) {
-        workGroup = workGroup.substr(1); //remove the comma
-        workGroup = workGroup.trim();
-      } else {
-        workGroup = '';
-      }
-      workGroup = templateSrv.replace(workGroup);
-      const namedQueryNames = await this.getNamedQueryNames(region, workGroup);
-      return namedQueryNames.map(n => {
-        return { text: n, value: n };
-      });
-    }
-
-    const namedQueryQueryQuery = query.match(/^named_query_queries\(([^,]+?),\s?([^,]+)(,\s?.+)?\)/);
-    if (namedQueryQueryQuery) {
-      const region = templateSrv.replace(namedQueryQueryQuery[1]);
-      const pattern = templateSrv.replace(namedQueryQueryQuery[2], {}, 'regex');
-      let workGroup = namedQueryQueryQuery[3];
-      if (workGroup) {
-        workGroup = workGroup.substr(1); //remove the comma
-        workGroup = workGroup.trim();
-      } else {
-        workGroup = '';
-      }
-      workGroup = templateSrv.replace(workGroup);
-      const namedQueryQueries = await this.getNamedQueryQueries(region, pattern, workGroup);
-      return namedQueryQueries.map(n => {
-        return { text: n, value: n };
-      });
-    }
-
-    const queryExecutionIdsQuery = query.match(/^query_execution_ids\(([^,]+?),\s?([^,]+?),\s?([^,]+)(,\s?.+)?\)/);
-    if (queryExecutionIdsQuery) {
-      const region = templateSrv.replace(queryExecutionIdsQuery[1]);
-      const limit = parseInt(templateSrv.replace(queryExecutionIdsQuery[2]), 10);
-      const pattern = templateSrv.replace(queryExecutionIdsQuery[3], {}, 'regex');
-      let workGroup = queryExecutionIdsQuery[4];
-      if (workGroup) {
-        workGroup = workGroup.substr(1); //remove the comma
-        workGroup = workGroup.trim();
-      } else {
-        workGroup = '';
-      }
-      workGroup = templateSrv.replace(workGroup);
-      const to = new Date(parseInt(templateSrv.replace('$__to'), 10)).toISOString();
-
-      const queryExecutions = await this.getQueryExecutions(region, limit, pattern, workGroup, to);
-      return queryExecutions.map(n => {
-        const id = n.QueryExecutionId;
-        return { text: id, value: id };
-      });
-    }
-
-    const queryExecutionIdsByNameQuery = query.match(
-      /^query_execution_ids_by_name\(([^,]+?),\s?([^,]+?),\s?([^,]+)(,\s?.+)?\)/
-    );
-    if (queryExecutionIdsByNameQuery) {
-      const region = templateSrv.replace(queryExecutionIdsByNameQuery[1]);
-      const limit = parseInt(templateSrv.replace(queryExecutionIdsByNameQuery[2]), 10);
-      const pattern = templateSrv.replace(queryExecutionIdsByNameQuery[3], {}, 'regex');
-      let workGroup = queryExecutionIdsByNameQuery[4];
-      if (workGroup) {
-        workGroup = workGroup.substr(1); //remove the comma
-        workGroup = workGroup.trim();
-      } else {
-        workGroup = '';
-      }
-      workGroup = templateSrv.replace(workGroup);
-      const to = new Date(parseInt(templateSrv.replace('$__to'), 10)).toISOString();
-
-      const queryExecutionsByName = await this.getQueryExecutionsByName(region, limit, pattern, workGroup, to);
-      return queryExecutionsByName.map(n => {
-        const id = n.QueryExecutionId;
-        return { text: id, value: id };
-      });
+    const params: Record<string, string> = {
+      query: interpolateQueryString(query),
+      variables: JSON.stringify(this.getMacroVariables(query)),
+    };
+    if (options && options.range) {
+      params.from = options.range.from.toISOString();
+      params.to = options.range.to.toISOString();
+    } else {
+      params.to = new Date(parseInt(templateSrv.replace('$__to'), 10)).toISOString();
     }
-
-    return [];
+    return (await this.getResource('variable_query', params))['variable_query'];
   }
 }
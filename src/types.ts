@@ -4,7 +4,46 @@ export interface AwsAthenaOptions extends DataSourceJsonData {
   defaultRegion: string;
   profile: string;
   assumeRoleArn: string;
+  externalId?: string;
+  assumeRoleDuration?: string;
+  assumeRoleSessionName?: string;
+  intermediateRoleArn?: string;
+  allowedAssumeRoleArns?: string[];
+  athenaEndpoint?: string;
+  stsEndpoint?: string;
+  ec2Endpoint?: string;
+  s3Endpoint?: string;
+  glueEndpoint?: string;
+  httpProxy?: string;
   outputLocation: string;
+  prewarmQueries?: AwsAthenaPrewarmQuery[];
+  queryRegions?: string[];
+  allowDdl?: boolean;
+  allowDml?: boolean;
+  allowedTables?: string[];
+  scanLimitPolicy?: 'require' | 'max' | 'warn';
+  maxBytesScannedCutoffPerQuery?: number;
+  dailyScannedBytesBudget?: number;
+  userDailyScannedBytesBudget?: number;
+  budgetExceededAction?: 'refuse' | 'cache';
+  scanCostPerTerabyte?: number;
+  auditLogSink?: '' | 'logger' | 'file';
+  auditLogPath?: string;
+  attributionComment?: boolean;
+  workgroupRoutes?: AwsAthenaWorkgroupRoute[];
+}
+
+export interface AwsAthenaWorkgroupRoute {
+  orgIds?: number[];
+  users?: string[];
+  roles?: string[];
+  workgroup: string;
+}
+
+export interface AwsAthenaPrewarmQuery {
+  schedule: string;
+  range: string;
+  query: Partial<AwsAthenaQuery>;
 }
 
 export interface AwsAthenaSecureJsonData {
@@ -16,20 +55,54 @@ export enum AwsAuthType {
   KEY = 'keys',
   CREDENTIALS = 'credentials',
   ARN = 'arn',
+  WEB_IDENTITY = 'web_identity',
+  SSO = 'sso',
+}
+
+export type AwsAthenaFormat = '' | 'logs' | 'logs_volume' | 'annotations';
+
+// streamed queries are run through the stream_query resource and Grafana Live
+export type AwsAthenaStream = '' | 'progress' | 'tail';
+
+export interface AwsAthenaAsyncQueryStatus {
+  queryExecutionId: string;
+  state: string;
+  stateChangeReason?: string;
+  dataScannedBytes: number;
+  queueTimeMillis: number;
+  engineExecutionTimeMillis: number;
+  submissionDateTime?: string;
+  completionDateTime?: string;
 }
 
 export interface AwsAthenaQuery extends DataQuery {
   refId: string;
   region: string;
   workgroup: string;
+  assumeRoleArn?: string;
   queryExecutionId: string;
   inputs: any;
   timestampColumn: string;
   valueColumn: string;
   legendFormat: string;
+  format?: AwsAthenaFormat;
+  messageColumn?: string;
+  levelColumn?: string;
+  timeEndColumn?: string;
+  titleColumn?: string;
+  textColumn?: string;
+  tagsColumn?: string;
   timeFormat: string;
   maxRows: string;
   cacheDuration: string;
+  timeAlignment?: string;
+  stream?: AwsAthenaStream;
+  tailInterval?: string;
+  // run through the async query resources, the panel polls the state instead of waiting in a query request
+  async?: boolean;
   queryString: string;
+  variables?: Record<string, string[]>;
   outputLocation: string;
+  dashboardId?: number;
+  panelId?: number;
 }